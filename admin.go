@@ -0,0 +1,212 @@
+package geoip2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI provides the /geoip2/ endpoints for the Caddy admin API
+type adminAPI struct{}
+
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.geoip2",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+func (a adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/geoip2/lookups",
+			Handler: caddy.AdminHandlerFunc(a.handleLookups),
+		},
+		{
+			Pattern: "/geoip2/update",
+			Handler: caddy.AdminHandlerFunc(a.handleUpdate),
+		},
+		{
+			Pattern: "/geoip2/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+	}
+}
+
+// handleLookups streams lookups as they are served using server-sent events.
+// The sample_rate query parameter (0 to 1, default 1) controls the fraction of lookups that are sent.
+func (adminAPI) handleLookups(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	var sampleRate = 1.0
+	if v := r.URL.Query().Get("sample_rate"); v != "" {
+		var err error
+		sampleRate, err = strconv.ParseFloat(v, 64)
+		if err != nil || sampleRate <= 0 || sampleRate > 1 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("sample_rate must be a number between 0 and 1"),
+			}
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("streaming not supported"),
+		}
+	}
+
+	var sub = lookupTail.subscribe(sampleRate)
+	defer lookupTail.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case ev := <-sub.events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintf(w, "event: lookup\ndata: %s\n\n", data)
+			if err != nil {
+				return nil
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// updateResult is the outcome of updating one edition through the admin API
+type updateResult struct {
+	// success, failure, or skipped for databases that are not updated by Caddy
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// runningApp returns the geoip2 app of the running config
+func runningApp() (*GeoIp2, error) {
+	app, err := caddy.ActiveContext().AppIfConfigured(ModuleName)
+	if err != nil {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("geoip2 app is not configured"),
+		}
+	}
+
+	return app.(*GeoIp2), nil
+}
+
+// handleUpdate updates every database now and responds with the result of each edition.
+// It responds with 500 if any update failed.
+func (adminAPI) handleUpdate(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	g, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	var (
+		results = make(map[string]updateResult, len(g.databases))
+		status  = http.StatusOK
+	)
+	for _, db := range g.databases {
+		err := db.Update()
+		switch {
+		case errors.Is(err, errNotUpdated):
+			results[db.Edition()] = updateResult{Result: "skipped"}
+		case err != nil:
+			results[db.Edition()] = updateResult{Result: "failure", Error: err.Error()}
+			status = http.StatusInternalServerError
+		default:
+			results[db.Edition()] = updateResult{Result: "success"}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(results)
+}
+
+// databaseHealth is the health of one edition reported through the admin API
+type databaseHealth struct {
+	Healthy              bool       `json:"healthy"`
+	LastSuccessfulUpdate *time.Time `json:"last_successful_update,omitempty"`
+	NextUpdate           *time.Time `json:"next_update,omitempty"`
+}
+
+// optionalTime returns nil for the zero time so that it is left out of the response
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// handleHealth reports whether each database was successfully updated within twice its update interval.
+// It responds with 503 if any database is stale, for use as a readiness probe.
+func (adminAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	g, err := runningApp()
+	if err != nil {
+		return err
+	}
+
+	var (
+		health = make(map[string]databaseHealth, len(g.databases))
+		status = http.StatusOK
+	)
+	for _, db := range g.databases {
+		h := databaseHealth{
+			Healthy:              db.Healthy(),
+			LastSuccessfulUpdate: optionalTime(db.LastSuccessfulUpdate()),
+			NextUpdate:           optionalTime(db.NextUpdate()),
+		}
+		if !h.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		health[db.Edition()] = h
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(health)
+}
+
+var (
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
@@ -0,0 +1,64 @@
+package geoip2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// maxBatchLineSize is the most bytes allowed per IP in a batch request body
+const maxBatchLineSize = 64
+
+// batchResult collects placeholders set by a lookup, keyed by their name without the geoip2. prefix
+type batchResult map[string]any
+
+func (b batchResult) Set(variable string, value any) {
+	b[strings.TrimPrefix(variable, ModuleName+".")] = value
+}
+
+// serveBatch geolocates every IP in the request body
+func (m *Handler) serveBatch(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(m.BatchLimit)*maxBatchLineSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+		}
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	var ips = strings.FieldsFunc(string(body), func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r' || r == ' ' || r == '\t'
+	})
+	if len(ips) > m.BatchLimit {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("batch of %d IPs exceeds the limit of %d", len(ips), m.BatchLimit))
+	}
+
+	var results = make([]batchResult, 0, len(ips))
+	for _, ipStr := range ips {
+		var result = batchResult{"ip": ipStr}
+
+		ip, err := netip.ParseAddr(ipStr)
+		if err != nil {
+			result["error"] = "invalid IP address"
+		} else {
+			m.lookup(ip, result, m.databases)
+		}
+
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
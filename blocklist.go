@@ -0,0 +1,296 @@
+package geoip2
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(new(MatchBlocklist))
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	// Whether a prefix ends at this node, covering every address below it
+	terminal bool
+}
+
+// prefixTrie is a binary trie of IP prefixes
+type prefixTrie struct {
+	v4, v6 trieNode
+}
+
+func (t *prefixTrie) root(ip netip.Addr) *trieNode {
+	if ip.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+func (t *prefixTrie) insert(prefix netip.Prefix) {
+	var (
+		ip   = prefix.Addr()
+		node = t.root(ip)
+		b    = ip.AsSlice()
+	)
+
+	for i := 0; i < prefix.Bits(); i++ {
+		if node.terminal {
+			// Already covered by a shorter prefix
+			return
+		}
+
+		bit := b[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = new(trieNode)
+		}
+		node = node.children[bit]
+	}
+
+	node.terminal = true
+	node.children = [2]*trieNode{}
+}
+
+// contains reports whether ip is within any of the prefixes
+func (t *prefixTrie) contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+
+	var (
+		node = t.root(ip)
+		b    = ip.AsSlice()
+	)
+
+	for i := 0; i < ip.BitLen(); i++ {
+		if node.terminal {
+			return true
+		}
+
+		node = node.children[b[i/8]>>(7-i%8)&1]
+		if node == nil {
+			return false
+		}
+	}
+
+	return node.terminal
+}
+
+// loadBlocklist parses a file of IPs and CIDR prefixes, one per line. Empty lines and lines starting with # are ignored.
+func loadBlocklist(path string) (*prefixTrie, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		trie    = new(prefixTrie)
+		scanner = bufio.NewScanner(f)
+		line    int
+	)
+
+	for scanner.Scan() {
+		line++
+
+		var s = strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		trie.insert(prefix)
+	}
+
+	return trie, scanner.Err()
+}
+
+// parsePrefix parses a CIDR prefix, or a single IP as a prefix of its full length
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		// Mapped IPv4 prefixes are stored as IPv4
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// MatchBlocklist matches when the client IP is within any of the IPs or CIDR prefixes listed in a file.
+// The file is reloaded when it changes.
+//
+//	geoip2_blocklist <path>
+type MatchBlocklist struct {
+	trie    atomic.Pointer[prefixTrie]
+	modTime time.Time
+	cancel  context.CancelFunc
+	log     *zap.Logger
+	state   *GeoIp2
+
+	// The file listing one IP or CIDR prefix per line. Lines starting with # are ignored
+	Path string `json:"path,omitempty"`
+	// How often to check the file for changes. Defaults to 30s
+	ReloadInterval caddy.Duration `json:"reload_interval,omitempty"`
+}
+
+func (*MatchBlocklist) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_blocklist",
+		New: func() caddy.Module { return new(MatchBlocklist) },
+	}
+}
+
+func (m *MatchBlocklist) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume matcher name
+	d.Args(&m.Path)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "path":
+			if !d.Args(&m.Path) {
+				return d.ArgErr()
+			}
+		case "reload_interval":
+			var value string
+			if !d.Args(&value) {
+				return d.ArgErr()
+			}
+			ReloadInterval, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid reload_interval: %v", err)
+			}
+			m.ReloadInterval = caddy.Duration(ReloadInterval)
+		default:
+			return d.Errf("unknown geoip2_blocklist option %q", d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+func (m *MatchBlocklist) Provision(ctx caddy.Context) error {
+	m.log = ctx.Logger()
+	if m.Path == "" {
+		return fmt.Errorf("geoip2_blocklist requires a path")
+	}
+	if m.ReloadInterval <= 0 {
+		m.ReloadInterval = caddy.Duration(30 * time.Second)
+	}
+
+	// The blocklist does not need any databases, but honors the app's settings when it is configured
+	if app, err := ctx.AppIfConfigured(ModuleName); err == nil {
+		m.state = app.(*GeoIp2)
+	}
+
+	err := m.reload()
+	if err != nil {
+		return err
+	}
+
+	var reloadCtx context.Context
+	reloadCtx, m.cancel = context.WithCancel(context.Background())
+	go m.watch(reloadCtx)
+
+	return nil
+}
+
+// reload loads the blocklist if it was modified since it was last loaded
+func (m *MatchBlocklist) reload() error {
+	fi, err := os.Stat(m.Path)
+	if err != nil {
+		return err
+	}
+	if m.trie.Load() != nil && fi.ModTime().Equal(m.modTime) {
+		return nil
+	}
+
+	trie, err := loadBlocklist(m.Path)
+	if err != nil {
+		return err
+	}
+
+	m.trie.Store(trie)
+	m.modTime = fi.ModTime()
+
+	return nil
+}
+
+func (m *MatchBlocklist) watch(ctx context.Context) {
+	var ticker = time.NewTicker(time.Duration(m.ReloadInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := m.reload()
+			if err != nil {
+				// Keep matching against the last list that loaded
+				m.log.Warn("failed to reload blocklist", zap.String("path", m.Path), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (m *MatchBlocklist) Cleanup() error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	return nil
+}
+
+func (m *MatchBlocklist) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+func (m *MatchBlocklist) MatchWithError(r *http.Request) (bool, error) {
+	ip, err := clientIP(r, m.state)
+	if err != nil {
+		return false, err
+	}
+
+	return m.trie.Load().contains(ip), nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module                      = (*MatchBlocklist)(nil)
+	_ caddy.Provisioner                 = (*MatchBlocklist)(nil)
+	_ caddy.CleanerUpper                = (*MatchBlocklist)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchBlocklist)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchBlocklist)(nil)
+)
@@ -0,0 +1,92 @@
+package geoip2
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+const (
+	// onBogonSkip does not look up bogon addresses, leaving the placeholders empty
+	onBogonSkip = "skip"
+	// onBogonBlock rejects requests from bogon addresses with 403
+	onBogonBlock = "block"
+	// onBogonOverride looks up a configured address instead of the bogon address
+	onBogonOverride = "override"
+)
+
+// defaultBogonPrefixes are reserved, private and documentation ranges that should never appear as a public client.
+// IPv6 addresses outside of 2000::/3 are not allocated, so only the reserved ranges within it are listed.
+var defaultBogonPrefixes = []string{
+	"0.0.0.0/8",       // this network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier-grade NAT
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link local
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved
+	"::/3",            // unallocated, including loopback and unspecified
+	"4000::/2",        // unallocated
+	"8000::/1",        // unallocated, private, link local and multicast
+	"2001:2::/48",     // benchmarking
+	"2001:10::/28",    // ORCHID
+	"2001:db8::/32",   // documentation
+	"3fff::/20",       // documentation
+}
+
+// bogons is a set of bogon prefixes
+type bogons []netip.Prefix
+
+// reservedRanges are the default bogon prefixes, which are never looked up in the web service
+var reservedRanges = func() bogons {
+	b, err := parseBogons(defaultBogonPrefixes)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// parseBogons parses prefixes in CIDR notation
+func parseBogons(prefixes []string) (bogons, error) {
+	var b = make(bogons, 0, len(prefixes))
+	for _, s := range prefixes {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bogon prefix: %w", err)
+		}
+
+		b = append(b, prefix.Masked())
+	}
+
+	return b, nil
+}
+
+// contains reports whether ip is within any of the bogon prefixes
+func (b bogons) contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range b {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPrivateIP reports whether ip is a private, loopback or link local address, which databases from MaxMind have no data for
+func isPrivateIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+}
+
+// isGlobalIP reports whether ip is a globally routable unicast address, which is neither private nor reserved
+func isGlobalIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !isPrivateIP(ip) && !reservedRanges.contains(ip)
+}
@@ -0,0 +1,93 @@
+package geoip2
+
+import (
+	"container/list"
+	"net/netip"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang/v2"
+)
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// lruCache is a fixed size cache that evicts the least recently used entry
+type lruCache[K comparable, V any] struct {
+	mx    sync.Mutex
+	size  int
+	order *list.List
+	items map[K]*list.Element
+}
+
+func newLRUCache[K comparable, V any](size int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		size:  size,
+		order: list.New(),
+		items: make(map[K]*list.Element, size),
+	}
+}
+
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).value, true
+}
+
+func (c *lruCache[K, V]) put(key K, value V) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value.(*lruEntry[K, V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[K, V]).key)
+	}
+}
+
+// purge removes every entry
+func (c *lruCache[K, V]) purge() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.order.Init()
+	clear(c.items)
+}
+
+// recordCaches holds the decoded records of a database by IP
+type recordCaches struct {
+	city    *lruCache[netip.Addr, *geoip2.City]
+	country *lruCache[netip.Addr, *geoip2.Country]
+	asn     *lruCache[netip.Addr, *geoip2.ASN]
+}
+
+func newRecordCaches(size int) *recordCaches {
+	return &recordCaches{
+		city:    newLRUCache[netip.Addr, *geoip2.City](size),
+		country: newLRUCache[netip.Addr, *geoip2.Country](size),
+		asn:     newLRUCache[netip.Addr, *geoip2.ASN](size),
+	}
+}
+
+func (c *recordCaches) purge() {
+	c.city.purge()
+	c.country.purge()
+	c.asn.purge()
+}
@@ -0,0 +1,44 @@
+package geoip2
+
+import "testing"
+
+func TestLRUCache(t *testing.T) {
+	var c = newLRUCache[string, int](2)
+	c.put("a", 1)
+	c.put("b", 2)
+
+	// Getting a refreshes it, so b is the least recently used when c is put
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Errorf("get(a) = %d, %v, want 1, true", v, ok)
+	}
+	c.put("c", 3)
+
+	if _, ok := c.get("b"); ok {
+		t.Error("b was not evicted")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if v, ok := c.get(key); !ok || v != want {
+			t.Errorf("get(%s) = %d, %v, want %d, true", key, v, ok, want)
+		}
+	}
+
+	// Putting an existing key replaces its value and refreshes it, so c is evicted
+	c.put("a", 10)
+	c.put("d", 4)
+	if _, ok := c.get("c"); ok {
+		t.Error("c was not evicted")
+	}
+	if v, ok := c.get("a"); !ok || v != 10 {
+		t.Errorf("get(a) = %d, %v, want 10, true", v, ok)
+	}
+	if n := c.order.Len(); n != 2 || len(c.items) != 2 {
+		t.Errorf("cache holds %d entries and %d items, want 2", n, len(c.items))
+	}
+
+	c.purge()
+	for _, key := range []string{"a", "d"} {
+		if _, ok := c.get(key); ok {
+			t.Errorf("%s was not purged", key)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package geoip2
+
+import (
+	"strings"
+)
+
+// cdnOrgKeywords identify content delivery networks by their AS organization name
+var cdnOrgKeywords = []string{
+	"akamai",
+	"cloudflare",
+	"cloudfront",
+	"fastly",
+	"edgecast",
+	"limelight",
+	"stackpath",
+	"incapsula",
+	"imperva",
+	"sucuri",
+	"cdn77",
+	"bunnycdn",
+}
+
+// isCDNOrg reports whether an AS organization name belongs to a known content delivery network
+func isCDNOrg(asnOrg string) bool {
+	asnOrg = strings.ToLower(asnOrg)
+	for _, k := range cdnOrgKeywords {
+		if strings.Contains(asnOrg, k) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// networkTraits are the traits of the network of an IP, collected from the records decoded by a lookup
+// so that the network can be classified without decoding them again
+type networkTraits struct {
+	// Whether any database had data for the network
+	found bool
+	// Whether any record flagged the network as anycast
+	anycast bool
+	// The Enterprise user type of the network
+	userType string
+	// Whether the Anonymous IP edition flagged the network as a hosting provider
+	hosting bool
+	// The AS organization of the network, preferably from the Enterprise edition
+	asnOrg string
+}
+
+// setCDNEdge sets whether the network is likely the edge of a content delivery network rather than a real user.
+// This is the case for anycast networks, networks the Enterprise edition classifies as a CDN
+// and networks owned by a known CDN.
+func (m *Handler) setCDNEdge(repl placeholderSetter, traits networkTraits) {
+	if !traits.found {
+		return
+	}
+
+	repl.Set("geoip2.is_anycast", traits.anycast)
+	repl.Set("geoip2.is_cdn_edge", traits.anycast || traits.userType == "content_delivery_network" || isCDNOrg(traits.asnOrg))
+}
@@ -2,63 +2,455 @@ package geoip2
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
+	"github.com/fsnotify/fsnotify"
 	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate"
 	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate/database"
 	"github.com/oschwald/geoip2-golang/v2"
+	"github.com/oschwald/maxminddb-golang/v2"
 	"go.uber.org/zap"
+	"math/rand/v2"
+	"net"
+	"net/http"
 	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-func update(config *geoipupdate.Config, edition, filePath string) error {
-	var (
+// updateLocks serializes updates of the same file within this process, keyed by file path.
+// The lock file taken by geoipupdate fails immediately rather than waiting when it is already held,
+// which would otherwise make concurrent updates of the same database fail, such as during a config reload.
+var updateLocks sync.Map
+
+// update downloads the latest edition to filePath and reports whether the file was replaced.
+// The MD5 of the existing file is sent along with the request so that the download is skipped entirely
+// if the database has not changed; MaxMind does not offer partial or delta updates.
+// If keepVersions is set, filePath is a symlink to the current of that many versions named by their content hash.
+func update(config *geoipupdate.Config, client *http.Client, edition, filePath string, keepVersions int) (bool, error) {
+	mx, _ := updateLocks.LoadOrStore(filePath, new(sync.Mutex))
+	mx.(*sync.Mutex).Lock()
+	defer mx.(*sync.Mutex).Unlock()
+
+	if client == nil {
 		client = geoipupdate.NewClient(config)
-		reader = database.NewHTTPDatabaseReader(client, config)
-	)
+	}
+	client = withProgress(client, caddy.Log().Named(ModuleName).With(zap.String("edition", edition)))
+	var reader = database.NewHTTPDatabaseReader(client, config)
+
+	before, _ := os.Stat(filePath)
 
 	w, err := database.NewLocalFileDatabaseWriter(filePath, filePath+".lock", config.Verbose)
 	if err != nil {
-		return err
+		return false, noSpace(filePath, err)
 	}
 
 	err = reader.Get(w, edition)
 	if err != nil {
-		return fmt.Errorf("updating database at %s: %w", filePath, err)
+		return false, noSpace(filePath, fmt.Errorf("updating database at %s: %w", filePath, err))
+	}
+
+	// A new database is moved into place over the old one
+	after, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	if keepVersions > 0 {
+		if err := keepVersion(filePath, keepVersions); err != nil {
+			return false, noSpace(filePath, fmt.Errorf("keeping version of database at %s: %w", filePath, err))
+		}
+	}
+
+	return before == nil || !os.SameFile(before, after), nil
+}
+
+// newUpdateClient returns an HTTP client for downloading updates whose connections originate from sourceAddress
+func newUpdateClient(config *geoipupdate.Config, sourceAddress netip.Addr) *http.Client {
+	var dialer = &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(sourceAddress, 0)),
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if config.Proxy != nil {
+		transport.Proxy = http.ProxyURL(config.Proxy)
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// defaultFilePattern is the name of the files written by geoipupdate
+const defaultFilePattern = "{edition}.mmdb"
+
+// databasePath returns the path of the database file for edition in dataDir.
+// {edition} in pattern is replaced by the edition ID, and if the pattern is a glob the most recently modified match is used.
+// Without a match, the default file name is used so that the database can be downloaded.
+func databasePath(dataDir, pattern, edition string) (string, error) {
+	var fallback = filepath.Join(dataDir, strings.ReplaceAll(defaultFilePattern, "{edition}", edition))
+	if pattern == "" {
+		return fallback, nil
+	}
+
+	var path = filepath.Join(dataDir, strings.ReplaceAll(pattern, "{edition}", edition))
+	matches, err := filepath.Glob(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid file pattern: %w", err)
+	}
+	if len(matches) == 0 {
+		// A pattern without wildcards names the file to download to
+		if !strings.ContainsAny(pattern, "*?[") {
+			return path, nil
+		}
+		return fallback, nil
 	}
 
+	var newest string
+	var newestTime time.Time
+	for _, match := range matches {
+		fi, err := os.Stat(match)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		// Ties go to the last match in lexical order, which is the latest for date stamped names
+		if newest == "" || !fi.ModTime().Before(newestTime) {
+			newest, newestTime = match, fi.ModTime()
+		}
+	}
+	if newest == "" {
+		return fallback, nil
+	}
+
+	return newest, nil
+}
+
+// noSpace makes err actionable if it was caused by the database directory running out of disk space.
+// The partially written temporary file is removed so that it does not hold on to the remaining space.
+func noSpace(filePath string, err error) error {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+
+	_ = os.Remove(filePath + ".temporary")
+
+	return fmt.Errorf("no space left on device to write database %s, free up space in %s or change database_directory: %w",
+		filepath.Base(filePath), filepath.Dir(filePath), err)
+}
+
+// databaseKind is a set of the GeoIP2 lookups supported by a database
+type databaseKind int
+
+const (
+	kindAnonymousIP databaseKind = 1 << iota
+	kindASN
+	kindCity
+	kindCountry
+	kindEnterprise
+)
+
+// kindOf returns the lookups supported by a database of databaseType, like the GeoIP2 reader does.
+// Databases of other types support none, but can still be used with LookupRaw.
+func kindOf(databaseType string) databaseKind {
+	switch databaseType {
+	case "GeoIP2-Anonymous-IP":
+		return kindAnonymousIP
+	case "DBIP-ASN-Lite (compat=GeoLite2-ASN)",
+		"GeoLite2-ASN",
+		"GeoIP2-ISP", "GeoIP2-Precision-ISP":
+		return kindASN
+	// City lookups are allowed on Country databases for compatibility
+	case "DBIP-City-Lite",
+		"DBIP-Country-Lite",
+		"DBIP-Country",
+		"DBIP-Location (compat=City)",
+		"GeoLite2-City",
+		"GeoIP-City-Redacted-US",
+		"GeoIP2-City",
+		"GeoIP2-City-Africa",
+		"GeoIP2-City-Asia-Pacific",
+		"GeoIP2-City-Europe",
+		"GeoIP2-City-North-America",
+		"GeoIP2-City-South-America",
+		"GeoIP2-Precision-City",
+		"GeoLite2-Country",
+		"GeoIP2-Country":
+		return kindCity | kindCountry
+	case "DBIP-ISP (compat=Enterprise)",
+		"DBIP-Location-ISP (compat=Enterprise)",
+		"GeoIP-Enterprise-Redacted-US",
+		"GeoIP2-Enterprise":
+		return kindEnterprise | kindCity | kindCountry
+	default:
+		return 0
+	}
+}
+
+// reader looks up GeoIP2 records in a MaxMind DB reader, which is also used directly for raw lookups
+type reader struct {
+	mmdb *maxminddb.Reader
+	kind databaseKind
+
+	// Whether the database supports City lookups
+	city bool
+	// Whether the database is from DB-IP, which may name some fields differently
+	dbip bool
+}
+
+// supports returns an InvalidMethodError if the database does not support the lookup method of kind
+func (r *reader) supports(kind databaseKind, method string) error {
+	if r.kind&kind == 0 {
+		return geoip2.InvalidMethodError{Method: method, DatabaseType: r.mmdb.Metadata.DatabaseType}
+	}
 	return nil
 }
 
+// Metadata returns the metadata of the database
+func (r *reader) Metadata() maxminddb.Metadata {
+	return r.mmdb.Metadata
+}
+
+// Enterprise looks up the Enterprise record for ip
+func (r *reader) Enterprise(ip netip.Addr) (*geoip2.Enterprise, error) {
+	if err := r.supports(kindEnterprise, "Enterprise"); err != nil {
+		return nil, err
+	}
+
+	var (
+		result = r.mmdb.Lookup(ip)
+		rec    geoip2.Enterprise
+	)
+	if err := result.Decode(&rec); err != nil {
+		return &rec, err
+	}
+	rec.Traits.IPAddress = ip
+	rec.Traits.Network = result.Prefix()
+	return &rec, nil
+}
+
+// City looks up the City record for ip
+func (r *reader) City(ip netip.Addr) (*geoip2.City, error) {
+	if err := r.supports(kindCity, "City"); err != nil {
+		return nil, err
+	}
+
+	var (
+		result = r.mmdb.Lookup(ip)
+		rec    geoip2.City
+	)
+	if err := result.Decode(&rec); err != nil {
+		return &rec, err
+	}
+	rec.Traits.IPAddress = ip
+	rec.Traits.Network = result.Prefix()
+	return &rec, nil
+}
+
+// Country looks up the Country record for ip
+func (r *reader) Country(ip netip.Addr) (*geoip2.Country, error) {
+	if err := r.supports(kindCountry, "Country"); err != nil {
+		return nil, err
+	}
+
+	var (
+		result = r.mmdb.Lookup(ip)
+		rec    geoip2.Country
+	)
+	if err := result.Decode(&rec); err != nil {
+		return &rec, err
+	}
+	rec.Traits.IPAddress = ip
+	rec.Traits.Network = result.Prefix()
+	return &rec, nil
+}
+
+// AnonymousIP looks up the Anonymous IP record for ip
+func (r *reader) AnonymousIP(ip netip.Addr) (*geoip2.AnonymousIP, error) {
+	if err := r.supports(kindAnonymousIP, "AnonymousIP"); err != nil {
+		return nil, err
+	}
+
+	var (
+		result = r.mmdb.Lookup(ip)
+		rec    geoip2.AnonymousIP
+	)
+	if err := result.Decode(&rec); err != nil {
+		return &rec, err
+	}
+	rec.IPAddress = ip
+	rec.Network = result.Prefix()
+	return &rec, nil
+}
+
+// dbipASN is the ASN record of DB-IP databases that use as_number and as_organization instead of MaxMind's field names
+type dbipASN struct {
+	AutonomousSystemNumber       uint   `maxminddb:"as_number"`
+	AutonomousSystemOrganization string `maxminddb:"as_organization"`
+}
+
+// ASN looks up the ASN record for ip. Records of DB-IP databases without MaxMind's field names are decoded with DB-IP's.
+func (r *reader) ASN(ip netip.Addr) (*geoip2.ASN, error) {
+	var err = r.supports(kindASN, "ASN")
+	if err != nil && !r.dbip {
+		return nil, err
+	}
+
+	var (
+		result = r.mmdb.Lookup(ip)
+		rec    geoip2.ASN
+	)
+	if err == nil {
+		if err := result.Decode(&rec); err != nil {
+			return &rec, err
+		}
+		rec.IPAddress = ip
+		rec.Network = result.Prefix()
+		if !r.dbip || rec.HasData() {
+			return &rec, nil
+		}
+	}
+
+	var alt dbipASN
+	if decodeErr := result.Decode(&alt); decodeErr != nil {
+		return nil, decodeErr
+	}
+	// Databases without ASN data, like DB-IP City, still do not support ASN lookups
+	if err != nil && alt.AutonomousSystemNumber == 0 && alt.AutonomousSystemOrganization == "" {
+		return nil, err
+	}
+
+	return &geoip2.ASN{
+		IPAddress:                    ip,
+		Network:                      result.Prefix(),
+		AutonomousSystemNumber:       alt.AutonomousSystemNumber,
+		AutonomousSystemOrganization: alt.AutonomousSystemOrganization,
+	}, nil
+}
+
+// OpenOptions control how database files are opened and read
+type OpenOptions struct {
+	// Skip verifying the structure of downloaded databases, which is slow for large databases.
+	// A corrupt database that is not verified may return errors or invalid records from lookups.
+	SkipVerify bool
+	// Read the database into memory instead of memory mapping the file.
+	// This uses more memory, but lookups never wait on disk and the file can be modified while it is open.
+	LoadIntoMemory bool
+	// The number of decoded City, Country and ASN records each to cache by IP, which saves decoding them again
+	// for repeated lookups of the same clients. The cache is cleared when the database is updated. 0 disables caching
+	CacheSize int
+	// Reopen the database when its file is replaced, if it is not updated automatically
+	Watch bool
+}
+
+// openReader opens the database at filePath, verifying its structure first if verify is set.
+// Databases with a type unknown to GeoIP2 are still opened so that they can be used with LookupRaw.
+func openReader(filePath string, opts OpenOptions, verify bool) (*reader, error) {
+	var (
+		mmdb *maxminddb.Reader
+		err  error
+	)
+
+	if opts.LoadIntoMemory {
+		var b []byte
+		b, err = os.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		mmdb, err = maxminddb.FromBytes(b)
+	} else {
+		mmdb, err = maxminddb.Open(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if verify && !opts.SkipVerify {
+		if err := mmdb.Verify(); err != nil {
+			_ = mmdb.Close()
+			return nil, fmt.Errorf("verifying database at %s: %w", filePath, err)
+		}
+	}
+
+	var kind = kindOf(mmdb.Metadata.DatabaseType)
+	return &reader{
+		mmdb: mmdb,
+		kind: kind,
+		city: kind&kindCity != 0,
+		dbip: strings.HasPrefix(mmdb.Metadata.DatabaseType, "DBIP-"),
+	}, nil
+}
+
+func (r *reader) Close() error {
+	return r.mmdb.Close()
+}
+
+// RetryOptions control how failed automatic updates are retried
+type RetryOptions struct {
+	// The number of times a failed update is retried before waiting for the next scheduled update
+	Retries int
+	// The delay before the first retry, doubled for each following one
+	Interval time.Duration
+}
+
 // Database is a synchronous self-updating GeoIP2 database
 type Database struct {
 	mx sync.RWMutex
-	db *geoip2.Reader
+	db *reader
+
+	edition      string
+	filePath     string
+	maxAge       time.Duration
+	updateEvery  time.Duration
+	keepVersions int
+	retry        RetryOptions
+	opts         OpenOptions
+	cache        *recordCaches
+
+	// When the next automatic update is due in Unix nanoseconds, or 0 if there is none
+	nextUpdate atomic.Int64
+	// When the database was last updated or found to be up to date in Unix nanoseconds
+	lastSuccessfulUpdate atomic.Int64
+	// Downloads and opens the latest database, or nil if the database is not updated by Caddy
+	updater func() error
 
 	log    *zap.Logger
 	cancel context.CancelFunc
 	err    chan error
 }
 
-func NewDatabase(config *geoipupdate.Config, edition string, dataDir string, updateEvery time.Duration) (*Database, error) {
+// NewDatabase opens the database for edition at filePath, downloading it first if it does not exist and config is set.
+// Updates are downloaded using client, or the default geoipupdate client if nil.
+// If keepVersions is set, that many previous versions of the database are kept next to it, see keep_versions.
+// Failed automatic updates are retried according to retry.
+func NewDatabase(config *geoipupdate.Config, client *http.Client, edition string, filePath string, updateEvery time.Duration, maxAge time.Duration, keepVersions int, retry RetryOptions, opts OpenOptions) (*Database, error) {
 	var ctx, cancel = context.WithCancel(context.Background())
-	var filePath = filepath.Join(dataDir, edition+".mmdb")
 
 	var db = &Database{
-		log:    caddy.Log().Named(ModuleName).With(zap.String("edition", edition)),
-		cancel: cancel,
-		err:    make(chan error, 1),
+		edition:      edition,
+		filePath:     filePath,
+		maxAge:       maxAge,
+		updateEvery:  updateEvery,
+		keepVersions: keepVersions,
+		retry:        retry,
+		opts:         opts,
+		log:          caddy.Log().Named(ModuleName).With(zap.String("edition", edition)),
+		cancel:       cancel,
+		err:          make(chan error, 1),
 	}
 
 	// Check if the database exists
-	_, err := os.Stat(filePath)
+	fi, err := os.Stat(filePath)
+	var existed = err == nil
 	if os.IsNotExist(err) && config != nil {
 		// No existing database but there is an update config, try loading it
-		err = update(config, edition, filePath)
+		_, err = update(config, client, edition, filePath, keepVersions)
 		if err != nil {
 			err = fmt.Errorf("no existing database at %s and self update failed: %w", filePath, err)
 		}
@@ -68,14 +460,48 @@ func NewDatabase(config *geoipupdate.Config, edition string, dataDir string, upd
 		return nil, err
 	}
 
-	db.db, err = geoip2.Open(filePath)
+	// Existing files were verified when they were downloaded
+	db.db, err = openReader(filePath, db.opts, !existed)
 	if err != nil {
 		return nil, err
 	}
+	if opts.CacheSize > 0 {
+		db.cache = newRecordCaches(opts.CacheSize)
+	}
+	if config != nil {
+		db.updater = db.selfUpdater(config, client, edition, filePath)
+
+		// The file was last written by an update, possibly by a previous run
+		if fi, err := os.Stat(filePath); err == nil {
+			db.lastSuccessfulUpdate.Store(fi.ModTime().UnixNano())
+		}
+	}
+
+	// An existing database is served straight away and refreshed in the background once it is due,
+	// unless the file was last checked longer ago than the maximum age, in which case startup waits for the update.
+	// The file is touched whenever it is found to be up to date, so a config reload or restart
+	// does not check for an update again until an interval after the last check.
+	// The build time is not used here, as MaxMind's newest build can itself be older than the maximum age.
+	var first = updateEvery + updateOffset(updateEvery)
+	if existed && config != nil {
+		if db.stale(fi.ModTime()) {
+			db.log.Info("database is older than max_age, updating before use")
+			err = db.updater()
+			if err != nil {
+				db.log.Warn("failed to update stale database, using it anyway", zap.Error(err))
+			}
+		} else {
+			first = max(updateEvery-time.Since(fi.ModTime()), 0)
+		}
+	}
+
+	db.checkAge()
 
 	// If there is an update config and self update is enabled on updateEvery
 	if config != nil && updateEvery > 0 {
-		go db.startAutomaticUpdates(ctx, config, edition, filePath, updateEvery)
+		go db.startAutomaticUpdates(ctx, first, updateEvery)
+	} else if opts.Watch {
+		go db.watchFile(ctx, filePath)
 	} else {
 		close(db.err)
 	}
@@ -83,52 +509,231 @@ func NewDatabase(config *geoipupdate.Config, edition string, dataDir string, upd
 	return db, nil
 }
 
-func (db *Database) selfUpdater(config *geoipupdate.Config, edition, filePath string) func() error {
-	return func() error {
-		db.mx.Lock()
-		defer db.mx.Unlock()
+func (db *Database) selfUpdater(config *geoipupdate.Config, client *http.Client, edition, filePath string) func() error {
+	return func() (err error) {
+		defer func() {
+			var result = "success"
+			if err != nil {
+				result = "failure"
+			}
+			updatesTotal.WithLabelValues(edition, result).Inc()
+			if err == nil {
+				db.lastSuccessfulUpdate.Store(time.Now().UnixNano())
+			}
+		}()
 
-		err := update(config, edition, filePath)
+		// Lookups continue on the current database while the update is downloaded and opened
+		modified, err := update(config, client, edition, filePath, db.keepVersions)
 		if err != nil {
 			return err
 		}
 
-		r, err := geoip2.Open(filePath)
+		if !modified {
+			if fi, err := os.Stat(filePath); err == nil {
+				updateBytesSavedTotal.WithLabelValues(edition).Add(float64(fi.Size()))
+			}
+			// The modification time records when the database was last checked, see NewDatabase
+			var now = time.Now()
+			_ = os.Chtimes(filePath, now, now)
+
+			db.log.Debug("Database is already up to date")
+			return nil
+		}
+
+		r, err := openReader(filePath, db.opts, true)
 		if err != nil {
 			return err
 		}
 
-		_ = db.db.Close()
-		db.db = r
-
+		db.swap(r)
 		return nil
 	}
 }
 
-func (db *Database) startAutomaticUpdates(ctx context.Context, config *geoipupdate.Config, edition, filePath string, updateEvery time.Duration) {
-	var ticker = time.NewTicker(updateEvery)
-	defer ticker.Stop()
+// swap replaces the open database with r, waiting for lookups on the current one to finish
+func (db *Database) swap(r *reader) {
+	db.mx.Lock()
+	defer db.mx.Unlock()
+
+	_ = db.db.Close()
+	db.db = r
+	if db.cache != nil {
+		db.cache.purge()
+	}
+}
+
+// watchSettle is how long a database file must go unchanged after an event before it is reopened,
+// so that a file that is written in place is not opened halfway through
+const watchSettle = time.Second
+
+// watchFile reopens the database when filePath is replaced or written to, until ctx is done.
+// The directory is watched rather than the file, as replacing the file by renaming over it would end a watch on the file itself.
+func (db *Database) watchFile(ctx context.Context, filePath string) {
+	defer close(db.err)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		db.log.Warn("failed to watch database file", zap.String("path", filePath), zap.Error(err))
+		return
+	}
+	defer watcher.Close()
+
+	if err = watcher.Add(filepath.Dir(filePath)); err != nil {
+		db.log.Warn("failed to watch database file", zap.String("path", filePath), zap.Error(err))
+		return
+	}
+
+	var (
+		name   = filepath.Clean(filePath)
+		settle <-chan time.Time
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == name && (event.Has(fsnotify.Create) || event.Has(fsnotify.Write)) {
+				settle = time.After(watchSettle)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			db.log.Warn("error watching database file", zap.String("path", filePath), zap.Error(err))
+		case <-settle:
+			settle = nil
+
+			// The current database stays open if the new file cannot be opened
+			r, err := openReader(filePath, db.opts, true)
+			if err != nil {
+				db.log.Warn("failed to reopen changed database file", zap.String("path", filePath), zap.Error(err))
+				continue
+			}
+
+			db.swap(r)
+			db.log.Info("reopened changed database file", zap.String("path", filePath))
+			db.checkAge()
+		}
+	}
+}
+
+// updateOffset returns a random offset of up to a tenth of updateEvery for the first update of a database.
+// This staggers the updates of editions sharing a frequency, so the memory spikes of reopening them do not overlap.
+func updateOffset(updateEvery time.Duration) time.Duration {
+	if updateEvery < 10 {
+		return 0
+	}
+	return rand.N(updateEvery / 10)
+}
+
+// startAutomaticUpdates updates the database after first, then every updateEvery
+func (db *Database) startAutomaticUpdates(ctx context.Context, first, updateEvery time.Duration) {
+	var timer = time.NewTimer(first)
+	defer timer.Stop()
+	db.nextUpdate.Store(time.Now().Add(first).UnixNano())
+	defer db.nextUpdate.Store(0)
 
-	db.log.Debug(fmt.Sprintf("Next update in %s", updateEvery))
+	db.log.Debug(fmt.Sprintf("Next update in %s", first))
 
 	defer close(db.err)
-	var updater = db.selfUpdater(config, edition, filePath)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-timer.C:
 			db.log.Debug("Updating database")
-			err := updater()
-			if err != nil {
+			err := db.retryUpdate(ctx, db.updater)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, syscall.ENOSPC) {
+				db.log.Error("disk is full, continuing with the current database", zap.Error(err))
+			} else if err != nil {
 				// Only log errors from updating (best effort)
 				db.log.Warn("failed to update db", zap.Error(err))
 			}
+
+			db.checkAge()
+
+			// The offset of the first update carries over to the following ones
+			timer.Reset(updateEvery)
+			db.nextUpdate.Store(time.Now().Add(updateEvery).UnixNano())
 		}
 	}
 }
 
+// errNotUpdated is returned by Update for databases that Caddy does not update
+var errNotUpdated = errors.New("database is not updated by caddy")
+
+// Update downloads and opens the latest database now, if there is a newer one.
+// It is safe to call while an automatic update is running, the updates of one file are serialized.
+func (db *Database) Update() error {
+	if db.updater == nil {
+		return errNotUpdated
+	}
+
+	err := db.updater()
+	db.checkAge()
+	return err
+}
+
+// retryUpdate runs updater, retrying failures up to the configured number of times with exponential backoff and jitter.
+// Running out of disk space is not retried, and retries stop when ctx is done.
+func (db *Database) retryUpdate(ctx context.Context, updater func() error) error {
+	var err = updater()
+
+	var delay = db.retry.Interval
+	for attempt := 1; err != nil && attempt <= db.retry.Retries && !errors.Is(err, syscall.ENOSPC); attempt++ {
+		var wait = delay + rand.N(delay/2+1)
+		db.log.Info("update failed, retrying", zap.Int("attempt", attempt), zap.Duration("wait", wait), zap.Error(err))
+
+		var timer = time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		err = updater()
+		delay *= 2
+	}
+
+	return err
+}
+
+// buildTime returns when the current database was built
+func (db *Database) buildTime() time.Time {
+	db.mx.RLock()
+	defer db.mx.RUnlock()
+
+	return db.db.Metadata().BuildTime()
+}
+
+// stale reports whether t is older than the maximum age of the database, if there is one
+func (db *Database) stale(t time.Time) bool {
+	return db.maxAge > 0 && time.Since(t) > db.maxAge
+}
+
+// checkAge logs a warning if the database build is older than the configured maximum age
+func (db *Database) checkAge() {
+	if db.maxAge <= 0 {
+		return
+	}
+
+	built := db.buildTime()
+	if age := time.Since(built); age > db.maxAge {
+		db.log.Warn("database is stale",
+			zap.Time("build_time", built),
+			zap.Duration("age", age),
+			zap.Duration("max_age", db.maxAge))
+	}
+}
+
 func (db *Database) Close() error {
 	db.cancel()
 	err := <-db.err
@@ -141,23 +746,235 @@ func (db *Database) Close() error {
 	return err
 }
 
-func (db *Database) ASN(ip netip.Addr) (*geoip2.ASN, error) {
+// Edition returns the edition ID this database was loaded for
+func (db *Database) Edition() string {
+	return db.edition
+}
+
+// NextUpdate returns when the next automatic update is due, or the zero time if the database is not updated automatically
+func (db *Database) NextUpdate() time.Time {
+	var next = db.nextUpdate.Load()
+	if next == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, next)
+}
+
+// LastSuccessfulUpdate returns when the database was last updated or found to be up to date,
+// or the zero time if it is not updated by Caddy
+func (db *Database) LastSuccessfulUpdate() time.Time {
+	last := db.lastSuccessfulUpdate.Load()
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// Healthy reports whether the database was successfully updated within twice its update interval.
+// Databases that are not updated automatically are always healthy.
+func (db *Database) Healthy() bool {
+	if db.updater == nil || db.updateEvery <= 0 {
+		return true
+	}
+	return time.Since(db.LastSuccessfulUpdate()) <= 2*db.updateEvery
+}
+
+// Metadata returns the metadata of the open database, which changes when the database is updated
+func (db *Database) Metadata() maxminddb.Metadata {
+	db.mx.RLock()
+	defer db.mx.RUnlock()
+
+	return db.db.Metadata()
+}
+
+// DatabaseType returns the type of the open database from its metadata, like GeoLite2-City
+func (db *Database) DatabaseType() string {
+	return db.Metadata().DatabaseType
+}
+
+// Available reports whether the database can be relied on for lookups:
+// its automatic updates are not failing, and it is not older than max_age.
+// Databases that Caddy updates are as current as their last successful check,
+// as MaxMind's newest build can itself be older than max_age.
+func (db *Database) Available() bool {
+	if !db.Healthy() {
+		return false
+	}
+	if db.updater != nil {
+		return !db.stale(db.LastSuccessfulUpdate())
+	}
+	return !db.stale(db.buildTime())
+}
+
+// countLookup counts a lookup and whether it failed in the metrics.
+// Lookups the database does not support are not counted.
+func (db *Database) countLookup(err *error) {
+	var invalidMethod geoip2.InvalidMethodError
+	if errors.As(*err, &invalidMethod) {
+		return
+	}
+
+	lookupsTotal.WithLabelValues(db.edition).Inc()
+	if *err != nil {
+		lookupErrorsTotal.WithLabelValues(db.edition).Inc()
+	}
+}
+
+// recoverLookup turns a panic while decoding the record for ip into an error,
+// so that a corrupt record leaves the lookup unresolved rather than failing the request
+func (db *Database) recoverLookup(ip netip.Addr, err *error) {
+	if v := recover(); v != nil {
+		db.log.Error("panic while looking up IP", zap.Stringer("ip", ip), zap.Any("panic", v), zap.Stack("stack"))
+		*err = fmt.Errorf("looking up %s: %v", ip, v)
+	}
+}
+
+func (db *Database) AnonymousIP(ip netip.Addr) (rec *geoip2.AnonymousIP, err error) {
+	db.mx.RLock()
+	defer db.mx.RUnlock()
+	defer db.countLookup(&err)
+	defer db.recoverLookup(ip, &err)
+
+	return db.db.AnonymousIP(ip)
+}
+
+// LookupRaw decodes the record for ip into out, which can be any struct using maxminddb tags.
+// This allows databases with custom schemas to be used. out is left unchanged if ip is not found.
+func (db *Database) LookupRaw(ip netip.Addr, out any) (err error) {
 	db.mx.RLock()
 	defer db.mx.RUnlock()
+	defer db.countLookup(&err)
+	defer db.recoverLookup(ip, &err)
 
-	return db.db.ASN(ip)
+	return db.db.mmdb.Lookup(ip).Decode(out)
 }
 
-func (db *Database) City(ip netip.Addr) (*geoip2.City, error) {
+// ASN looks up the ASN record for ip. Records may be shared with other callers through the cache and must not be modified.
+func (db *Database) ASN(ip netip.Addr) (rec *geoip2.ASN, err error) {
 	db.mx.RLock()
 	defer db.mx.RUnlock()
+	defer db.countLookup(&err)
+	defer db.recoverLookup(ip, &err)
 
-	return db.db.City(ip)
+	if db.cache == nil {
+		return db.db.ASN(ip)
+	}
+	if rec, ok := db.cache.asn.get(ip); ok {
+		cacheHitsTotal.WithLabelValues(db.edition).Inc()
+		return rec, nil
+	}
+	cacheMissesTotal.WithLabelValues(db.edition).Inc()
+
+	rec, err = db.db.ASN(ip)
+	if err == nil {
+		db.cache.asn.put(ip, rec)
+	}
+	return rec, err
 }
 
-func (db *Database) Country(ip netip.Addr) (*geoip2.Country, error) {
+// City looks up the City record for ip. Records may be shared with other callers through the cache and must not be modified.
+func (db *Database) City(ip netip.Addr) (rec *geoip2.City, err error) {
 	db.mx.RLock()
 	defer db.mx.RUnlock()
+	defer db.countLookup(&err)
+	defer db.recoverLookup(ip, &err)
 
-	return db.db.Country(ip)
+	if db.cache == nil {
+		return db.db.City(ip)
+	}
+	if rec, ok := db.cache.city.get(ip); ok {
+		cacheHitsTotal.WithLabelValues(db.edition).Inc()
+		return rec, nil
+	}
+	cacheMissesTotal.WithLabelValues(db.edition).Inc()
+
+	rec, err = db.db.City(ip)
+	if err == nil {
+		db.cache.city.put(ip, rec)
+	}
+	return rec, err
+}
+
+// CityFields looks up a City record for ip, decoding only the given field groups to reduce allocations.
+// The groups are country (including the continent, registered and represented country), city, postal and location.
+func (db *Database) CityFields(ip netip.Addr, fields []string) (rec *geoip2.City, err error) {
+	db.mx.RLock()
+	defer db.mx.RUnlock()
+	defer db.countLookup(&err)
+	defer db.recoverLookup(ip, &err)
+
+	if !db.db.city {
+		return nil, geoip2.InvalidMethodError{Method: "City", DatabaseType: db.db.Metadata().DatabaseType}
+	}
+
+	var result = db.db.mmdb.Lookup(ip)
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	rec = new(geoip2.City)
+	if !result.Found() {
+		return rec, nil
+	}
+
+	for _, field := range fields {
+		switch field {
+		case fieldsCountry:
+			err = errors.Join(
+				result.DecodePath(&rec.Country, "country"),
+				result.DecodePath(&rec.Continent, "continent"),
+				result.DecodePath(&rec.RegisteredCountry, "registered_country"),
+				result.DecodePath(&rec.RepresentedCountry, "represented_country"),
+			)
+		case fieldsCity:
+			err = errors.Join(
+				result.DecodePath(&rec.City, "city"),
+				result.DecodePath(&rec.Subdivisions, "subdivisions"),
+			)
+		case fieldsPostal:
+			err = result.DecodePath(&rec.Postal, "postal")
+		case fieldsLocation:
+			err = result.DecodePath(&rec.Location, "location")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rec.Traits.IPAddress = ip
+	rec.Traits.Network = result.Prefix()
+
+	return rec, nil
+}
+
+func (db *Database) Enterprise(ip netip.Addr) (rec *geoip2.Enterprise, err error) {
+	db.mx.RLock()
+	defer db.mx.RUnlock()
+	defer db.countLookup(&err)
+	defer db.recoverLookup(ip, &err)
+
+	return db.db.Enterprise(ip)
+}
+
+// Country looks up the Country record for ip. Records may be shared with other callers through the cache and must not be modified.
+func (db *Database) Country(ip netip.Addr) (rec *geoip2.Country, err error) {
+	db.mx.RLock()
+	defer db.mx.RUnlock()
+	defer db.countLookup(&err)
+	defer db.recoverLookup(ip, &err)
+
+	if db.cache == nil {
+		return db.db.Country(ip)
+	}
+	if rec, ok := db.cache.country.get(ip); ok {
+		cacheHitsTotal.WithLabelValues(db.edition).Inc()
+		return rec, nil
+	}
+	cacheMissesTotal.WithLabelValues(db.edition).Inc()
+
+	rec, err = db.db.Country(ip)
+	if err == nil {
+		db.cache.country.put(ip, rec)
+	}
+	return rec, err
 }
@@ -0,0 +1,252 @@
+package geoip2
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// writeDatabase writes a MaxMind DB of databaseType holding records by network, and returns its path
+func writeDatabase(tb testing.TB, databaseType string, records map[string]mmdbtype.Map) string {
+	tb.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType:            databaseType,
+		Languages:               []string{"en"},
+		IncludeReservedNetworks: true,
+		RecordSize:              24,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	for network, rec := range records {
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := tree.Insert(n, rec); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	var filePath = filepath.Join(tb.TempDir(), databaseType+".mmdb")
+	f, err := os.Create(filePath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := tree.WriteTo(f); err != nil {
+		tb.Fatal(err)
+	}
+
+	return filePath
+}
+
+// openDatabase opens the database file at filePath as edition, without updates
+func openDatabase(tb testing.TB, edition, filePath string, opts OpenOptions) *Database {
+	tb.Helper()
+
+	db, err := NewDatabase(nil, nil, edition, filePath, 0, 0, 0, RetryOptions{}, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = db.Close() })
+
+	return db
+}
+
+// names is a record of localized names with only an English name
+func names(en string) mmdbtype.Map {
+	return mmdbtype.Map{"en": mmdbtype.String(en)}
+}
+
+// cityDatabase writes a GeoLite2-City database with London in 81.2.69.0/24 and Berlin in 5.6.7.0/24
+func cityDatabase(tb testing.TB) string {
+	return writeDatabase(tb, "GeoLite2-City", map[string]mmdbtype.Map{
+		"81.2.69.0/24": {
+			"city":      mmdbtype.Map{"geoname_id": mmdbtype.Uint32(2643743), "names": names("London")},
+			"continent": mmdbtype.Map{"code": mmdbtype.String("EU"), "names": names("Europe")},
+			"country":   mmdbtype.Map{"iso_code": mmdbtype.String("GB"), "names": names("United Kingdom")},
+			"location": mmdbtype.Map{
+				"latitude":        mmdbtype.Float64(51.5142),
+				"longitude":       mmdbtype.Float64(-0.0931),
+				"time_zone":       mmdbtype.String("Europe/London"),
+				"accuracy_radius": mmdbtype.Uint16(10),
+			},
+		},
+		"5.6.7.0/24": {
+			"city":      mmdbtype.Map{"geoname_id": mmdbtype.Uint32(2950159), "names": names("Berlin")},
+			"continent": mmdbtype.Map{"code": mmdbtype.String("EU"), "names": names("Europe")},
+			"country":   mmdbtype.Map{"iso_code": mmdbtype.String("DE"), "names": names("Germany"), "is_in_european_union": mmdbtype.Bool(true)},
+			"location": mmdbtype.Map{
+				"latitude":  mmdbtype.Float64(52.52),
+				"longitude": mmdbtype.Float64(13.405),
+				"time_zone": mmdbtype.String("Europe/Berlin"),
+			},
+		},
+	})
+}
+
+func TestUpdateSerialized(t *testing.T) {
+	var inFlight, maxInFlight, requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+
+		// Give a concurrent update the chance to overlap with this one
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	var (
+		filePath = cityDatabase(t)
+		config   = &geoipupdate.Config{AccountID: 1, LicenseKey: "test", URL: srv.URL}
+		wg       sync.WaitGroup
+		errs     = make([]error, 2)
+	)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = update(config, srv.Client(), "GeoLite2-City", filePath, 0)
+		}()
+	}
+	wg.Wait()
+
+	// Without the lock, the second update fails on the lock file held by the first
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("update %d: %v", i, err)
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("got %d update requests, want 2", n)
+	}
+	if n := maxInFlight.Load(); n != 1 {
+		t.Errorf("got %d concurrent update requests, want 1", n)
+	}
+}
+
+func TestDBIP(t *testing.T) {
+	var asn = map[string]mmdbtype.Map{
+		"81.2.69.0/24": {
+			"as_number":       mmdbtype.Uint32(20712),
+			"as_organization": mmdbtype.String("Andrews & Arnold Ltd"),
+		},
+	}
+
+	for _, c := range []struct {
+		databaseType string
+		records      map[string]mmdbtype.Map
+		dbip         bool
+	}{
+		// DB-IP's own field names are decoded even if the type does not claim GeoLite2-ASN compatibility
+		{"DBIP-ASN-Lite", asn, true},
+		{"DBIP-ASN-Lite (compat=GeoLite2-ASN)", asn, true},
+		{"DBIP-ASN-Lite (compat=GeoLite2-ASN)", map[string]mmdbtype.Map{
+			"81.2.69.0/24": {
+				"autonomous_system_number":       mmdbtype.Uint32(20712),
+				"autonomous_system_organization": mmdbtype.String("Andrews & Arnold Ltd"),
+			},
+		}, true},
+		// Only DB-IP databases fall back to DB-IP's field names
+		{"GeoLite2-ASN", asn, false},
+	} {
+		t.Run(c.databaseType, func(t *testing.T) {
+			var db = openDatabase(t, "GeoLite2-ASN", writeDatabase(t, c.databaseType, c.records), OpenOptions{})
+			if db.db.dbip != c.dbip {
+				t.Errorf("dbip = %v, want %v", db.db.dbip, c.dbip)
+			}
+
+			rec, err := db.ASN(netip.MustParseAddr("81.2.69.1"))
+			if !c.dbip {
+				if err == nil && rec.HasData() {
+					t.Errorf("ASN record %+v decoded from DB-IP field names", rec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.AutonomousSystemNumber != 20712 || rec.AutonomousSystemOrganization != "Andrews & Arnold Ltd" {
+				t.Errorf("ASN record = %+v, want AS20712 Andrews & Arnold Ltd", rec)
+			}
+			if rec.Network.String() != "81.2.69.0/24" {
+				t.Errorf("ASN network = %s, want 81.2.69.0/24", rec.Network)
+			}
+		})
+	}
+}
+
+func TestDBIPCity(t *testing.T) {
+	var db = openDatabase(t, "GeoLite2-City", writeDatabase(t, "DBIP-City-Lite", map[string]mmdbtype.Map{
+		"81.2.69.0/24": {
+			"city":    mmdbtype.Map{"names": names("London")},
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String("GB")},
+		},
+	}), OpenOptions{})
+
+	rec, err := db.City(netip.MustParseAddr("81.2.69.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.City.Names.English != "London" || rec.Country.ISOCode != "GB" {
+		t.Errorf("City record = %+v, want London GB", rec)
+	}
+
+	// DB-IP City databases have no ASN data to fall back to
+	if _, err := db.ASN(netip.MustParseAddr("81.2.69.1")); err == nil {
+		t.Error("ASN lookup in a DB-IP City database returned no error")
+	}
+}
+
+func BenchmarkCity(b *testing.B) {
+	var filePath = cityDatabase(b)
+
+	for _, c := range []struct {
+		name string
+		opts OpenOptions
+	}{
+		{"uncached", OpenOptions{}},
+		{"cached", OpenOptions{CacheSize: 1024}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			var db = openDatabase(b, "GeoLite2-City", filePath, c.opts)
+
+			// Lookups of a few hundred clients, which all fit in the cache
+			var ips []netip.Addr
+			for i := range 256 {
+				ips = append(ips, netip.AddrFrom4([4]byte{81, 2, 69, byte(i)}))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+				if _, err := db.City(ips[i%len(ips)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
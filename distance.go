@@ -0,0 +1,55 @@
+package geoip2
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// earthRadiusKm is the mean radius of the Earth in kilometers
+const earthRadiusKm = 6371.0
+
+// Point is a location given by its latitude and longitude in degrees
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// parsePoint parses a latitude and longitude in degrees
+func parsePoint(lat, lon string) (Point, error) {
+	var (
+		p   Point
+		err error
+	)
+	if p.Lat, err = strconv.ParseFloat(lat, 64); err != nil {
+		return p, fmt.Errorf("invalid latitude: %v", err)
+	}
+	if p.Lon, err = strconv.ParseFloat(lon, 64); err != nil {
+		return p, fmt.Errorf("invalid longitude: %v", err)
+	}
+
+	return p, p.validate()
+}
+
+func (p Point) validate() error {
+	if p.Lat < -90 || p.Lat > 90 {
+		return fmt.Errorf("latitude %v out of range", p.Lat)
+	}
+	if p.Lon < -180 || p.Lon > 180 {
+		return fmt.Errorf("longitude %v out of range", p.Lon)
+	}
+
+	return nil
+}
+
+// distanceKm returns the great-circle distance in kilometers between p and a location, using the haversine formula
+func (p Point) distanceKm(lat, lon float64) float64 {
+	var (
+		rad  = math.Pi / 180
+		dLat = (lat - p.Lat) * rad
+		dLon = (lon - p.Lon) * rad
+		a    = math.Pow(math.Sin(dLat/2), 2) + math.Cos(p.Lat*rad)*math.Cos(lat*rad)*math.Pow(math.Sin(dLon/2), 2)
+	)
+
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
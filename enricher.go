@@ -0,0 +1,14 @@
+package geoip2
+
+import (
+	"net/netip"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Enricher adds placeholders of its own after the built-in lookups, such as tags from an internal asset inventory.
+// Enrichers are Caddy modules in the http.handlers.geoip2.enrichers namespace.
+// repl holds the placeholders resolved for ip so far.
+type Enricher interface {
+	Enrich(ip netip.Addr, repl *caddy.Replacer)
+}
@@ -0,0 +1,212 @@
+package geoip2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// splitQuoted splits s on sep, ignoring separators inside quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var (
+		parts   []string
+		start   int
+		quoted  bool
+		escaped bool
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// unquote removes the quotes and escapes of an RFC 7230 quoted-string.
+// Tokens that are not quoted are returned as-is.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+
+	var b strings.Builder
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// forwardedFor returns the values of every for= parameter across the given Forwarded header values, in order.
+// See RFC 7239 section 4.
+func forwardedFor(values []string) []string {
+	var nodes []string
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			for _, pair := range splitQuoted(element, ';') {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(k, "for") {
+					continue
+				}
+
+				nodes = append(nodes, unquote(strings.TrimSpace(v)))
+			}
+		}
+	}
+
+	return nodes
+}
+
+// parseNode parses an RFC 7239 node into an IP address.
+// Obfuscated identifiers and "unknown" do not resolve to an address.
+func parseNode(node string) (netip.Addr, bool) {
+	// Bracketed IPv6 with an optional port, e.g. [2001:db8:cafe::17]:4711
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return netip.Addr{}, false
+		}
+		node = node[1:end]
+	} else if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+
+	addr, err := netip.ParseAddr(node)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.WithZone(""), true
+}
+
+const (
+	// allTrustedLeftmost uses the left-most address when every hop of a chain is a trusted proxy, trusting the whole chain
+	allTrustedLeftmost = "leftmost"
+	// allTrustedUnknown leaves the client unresolved when every hop of a chain is a trusted proxy
+	allTrustedUnknown = "unknown"
+)
+
+// privateRanges are the ranges trusted_proxies private_ranges expands to, like Caddy's trusted_proxies
+var privateRanges = []string{
+	"192.168.0.0/16", "172.16.0.0/12", "10.0.0.0/8", "127.0.0.1/8", "fd00::/8", "::1",
+}
+
+// parseTrustedProxies parses the trusted proxy ranges in CIDR notation, expanding private_ranges
+func parseTrustedProxies(ranges []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range ranges {
+		if s == "private_ranges" {
+			p, err := parseTrustedProxies(privateRanges)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p...)
+			continue
+		}
+
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// trustedPeer reports whether the direct peer of r is one of the trusted_proxies of Caddy's server.
+// Forwarded, X-Forwarded-For and trusted_ip_header are all only honored from such a peer,
+// so that the handler trusts the same proxies as Caddy and the matchers.
+func trustedPeer(r *http.Request) bool {
+	trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool)
+	return trusted
+}
+
+// xForwardedForIP returns the client from the X-Forwarded-For header if the direct peer of r is trusted by Caddy.
+// Like the Forwarded header, the chain is walked from the right skipping trusted_proxies,
+// and an entry that is not an IP address reached before the client leaves the client unknown.
+func (m *Handler) xForwardedForIP(r *http.Request) (netip.Addr, bool) {
+	if !trustedPeer(r) {
+		return netip.Addr{}, false
+	}
+
+	var hops []netip.Addr
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(value, ",") {
+			addr, _ := parseNode(strings.TrimSpace(entry))
+			hops = append(hops, addr)
+		}
+	}
+
+	return m.clientHop(hops)
+}
+
+// trustedHeaderIP returns the IP from the trusted_ip_header if the direct peer of r is trusted by Caddy
+func (m *Handler) trustedHeaderIP(r *http.Request) (netip.Addr, bool) {
+	if !trustedPeer(r) {
+		return netip.Addr{}, false
+	}
+
+	value := strings.TrimSpace(r.Header.Get(m.TrustedIPHeader))
+	if value == "" {
+		return netip.Addr{}, false
+	}
+
+	return parseNode(value)
+}
+
+// trustedProxy reports whether ip is within any of the trusted proxy ranges
+func (m *Handler) trustedProxy(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range m.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientHop returns the client from a chain of hops ordered from the client to the last proxy.
+// Walking from the right, the first hop that is not a trusted proxy is the client.
+// If every hop is trusted the client is the left-most hop or unknown, depending on all_trusted.
+// A hop that could not be parsed is the zero Addr and ends the chain, as the hops left of it
+// cannot be attributed to a trusted proxy, so the client is unknown.
+func (m *Handler) clientHop(hops []netip.Addr) (netip.Addr, bool) {
+	if len(hops) == 0 {
+		return netip.Addr{}, false
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !hops[i].IsValid() {
+			return netip.IPv4Unspecified(), true
+		}
+		if !m.trustedProxy(hops[i]) {
+			return hops[i], true
+		}
+	}
+
+	if m.AllTrusted == allTrustedLeftmost {
+		return hops[0], true
+	}
+
+	return netip.IPv4Unspecified(), true
+}
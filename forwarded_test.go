@@ -0,0 +1,229 @@
+package geoip2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestSplitQuoted(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		sep  byte
+		want []string
+	}{
+		{`for=1.2.3.4`, ',', []string{`for=1.2.3.4`}},
+		{`for=1.2.3.4, for=5.6.7.8`, ',', []string{`for=1.2.3.4`, ` for=5.6.7.8`}},
+		{`for=1.2.3.4;proto=https`, ';', []string{`for=1.2.3.4`, `proto=https`}},
+		// Separators inside quoted-strings do not split
+		{`for="a,b", for=5.6.7.8`, ',', []string{`for="a,b"`, ` for=5.6.7.8`}},
+		{`for="a;b";by=x`, ';', []string{`for="a;b"`, `by=x`}},
+		// An escaped quote does not end the quoted-string
+		{`for="a\",b", for=5.6.7.8`, ',', []string{`for="a\",b"`, ` for=5.6.7.8`}},
+		{``, ',', []string{``}},
+	} {
+		if got := splitQuoted(c.s, c.sep); !slices.Equal(got, c.want) {
+			t.Errorf("splitQuoted(%q, %q) = %q, want %q", c.s, c.sep, got, c.want)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	for _, c := range []struct {
+		s, want string
+	}{
+		{`1.2.3.4`, `1.2.3.4`},
+		{`"1.2.3.4"`, `1.2.3.4`},
+		{`"[2001:db8::1]:4711"`, `[2001:db8::1]:4711`},
+		{`"a\"b"`, `a"b`},
+		{`"a\\b"`, `a\b`},
+		{`"a,b"`, `a,b`},
+		// Tokens that are not fully quoted are returned as-is
+		{`"unterminated`, `"unterminated`},
+		{`"`, `"`},
+		{``, ``},
+	} {
+		if got := unquote(c.s); got != c.want {
+			t.Errorf("unquote(%q) = %q, want %q", c.s, got, c.want)
+		}
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"single", []string{`for=192.0.2.60`}, []string{`192.0.2.60`}},
+		{"case insensitive", []string{`For=192.0.2.60`}, []string{`192.0.2.60`}},
+		{"with other parameters", []string{`for=192.0.2.60;proto=http;by=203.0.113.43`}, []string{`192.0.2.60`}},
+		{"without for", []string{`proto=https;by=203.0.113.43`}, nil},
+		{"quoted IPv6 with port", []string{`for="[2001:db8::1]:4711"`}, []string{`[2001:db8::1]:4711`}},
+		{"escaped quote", []string{`for="_a\"b", for=198.51.100.17`}, []string{`_a"b`, `198.51.100.17`}},
+		{"comma inside quotes", []string{`for="_a,b";proto=https, for=198.51.100.17`}, []string{`_a,b`, `198.51.100.17`}},
+		{"several elements", []string{`for=192.0.2.43, for=198.51.100.17`}, []string{`192.0.2.43`, `198.51.100.17`}},
+		{"several headers", []string{`for=192.0.2.43`, `for=198.51.100.17`}, []string{`192.0.2.43`, `198.51.100.17`}},
+		{"spaces around pairs", []string{`for=192.0.2.43 ; proto=http`}, []string{`192.0.2.43`}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := forwardedFor(c.values); !slices.Equal(got, c.want) {
+				t.Errorf("forwardedFor(%q) = %q, want %q", c.values, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseNode(t *testing.T) {
+	for _, c := range []struct {
+		node string
+		want string
+		ok   bool
+	}{
+		{`192.0.2.60`, `192.0.2.60`, true},
+		{`192.0.2.60:4711`, `192.0.2.60`, true},
+		{`[2001:db8::1]:4711`, `2001:db8::1`, true},
+		{`[2001:db8::1]`, `2001:db8::1`, true},
+		{`2001:db8::1`, `2001:db8::1`, true},
+		{`[2001:db8::1`, ``, false},
+		{`unknown`, ``, false},
+		{`_hidden`, ``, false},
+	} {
+		addr, ok := parseNode(c.node)
+		if ok != c.ok || ok && addr.String() != c.want {
+			t.Errorf("parseNode(%q) = %v, %v, want %s, %v", c.node, addr, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestClientHop(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"private_ranges", "203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hops = func(ips ...string) []netip.Addr {
+		var addrs []netip.Addr
+		for _, ip := range ips {
+			addrs = append(addrs, netip.MustParseAddr(ip))
+		}
+		return addrs
+	}
+
+	for _, c := range []struct {
+		name       string
+		allTrusted string
+		hops       []netip.Addr
+		want       netip.Addr
+		ok         bool
+	}{
+		{"empty", allTrustedUnknown, nil, netip.Addr{}, false},
+		{"untrusted only", allTrustedUnknown, hops("198.51.100.17"), netip.MustParseAddr("198.51.100.17"), true},
+		{"client behind trusted proxies", allTrustedUnknown, hops("198.51.100.17", "203.0.113.5", "10.0.0.1"), netip.MustParseAddr("198.51.100.17"), true},
+		// The right-most untrusted hop is the client, anything left of it may be spoofed
+		{"spoofed hops left of client", allTrustedUnknown, hops("192.0.2.1", "198.51.100.17", "10.0.0.1"), netip.MustParseAddr("198.51.100.17"), true},
+		{"trusted hop left of client", allTrustedUnknown, hops("10.0.0.2", "198.51.100.17", "203.0.113.5"), netip.MustParseAddr("198.51.100.17"), true},
+		{"IPv4-mapped trusted proxy", allTrustedUnknown, hops("198.51.100.17", "::ffff:10.0.0.1"), netip.MustParseAddr("198.51.100.17"), true},
+		{"IPv6 client behind trusted proxy", allTrustedUnknown, hops("2001:db8::1", "fd00::1"), netip.MustParseAddr("2001:db8::1"), true},
+		{"all trusted unknown", allTrustedUnknown, hops("10.0.0.2", "203.0.113.5", "10.0.0.1"), netip.IPv4Unspecified(), true},
+		{"all trusted default", "", hops("10.0.0.2", "10.0.0.1"), netip.IPv4Unspecified(), true},
+		{"all trusted leftmost", allTrustedLeftmost, hops("10.0.0.2", "203.0.113.5", "10.0.0.1"), netip.MustParseAddr("10.0.0.2"), true},
+		{"mixed leftmost", allTrustedLeftmost, hops("10.0.0.2", "198.51.100.17", "10.0.0.1"), netip.MustParseAddr("198.51.100.17"), true},
+		// A hop that could not be parsed ends the chain, the hops left of it may be spoofed
+		{"unparseable hop", allTrustedUnknown, []netip.Addr{netip.MustParseAddr("198.51.100.17"), {}, netip.MustParseAddr("10.0.0.1")}, netip.IPv4Unspecified(), true},
+		{"unparseable hop leftmost", allTrustedLeftmost, []netip.Addr{netip.MustParseAddr("10.0.0.2"), {}, netip.MustParseAddr("10.0.0.1")}, netip.IPv4Unspecified(), true},
+		{"unparseable hop left of client", allTrustedUnknown, []netip.Addr{{}, netip.MustParseAddr("198.51.100.17"), netip.MustParseAddr("10.0.0.1")}, netip.MustParseAddr("198.51.100.17"), true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var m = &Handler{AllTrusted: c.allTrusted, trustedProxies: trusted}
+			got, ok := m.clientHop(c.hops)
+			if ok != c.ok || got != c.want {
+				t.Errorf("clientHop(%v) = %v, %v, want %v, %v", c.hops, got, ok, c.want, c.ok)
+			}
+		})
+	}
+}
+
+// proxiedRequest returns a request with the given forwarding headers, from a peer that is trusted if trusted is set
+func proxiedRequest(trusted bool, header string, values ...string) *http.Request {
+	var r = httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, value := range values {
+		r.Header.Add(header, value)
+	}
+	return r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{
+		caddyhttp.TrustedProxyVarKey: trusted,
+	}))
+}
+
+func TestForwardedIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"private_ranges"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name           string
+		trustedProxies []netip.Prefix
+		values         []string
+		want           netip.Addr
+		ok             bool
+	}{
+		{"client", nil, []string{`for=198.51.100.17`}, netip.MustParseAddr("198.51.100.17"), true},
+		{"client behind trusted proxy", trusted, []string{`for=198.51.100.17, for=10.0.0.1`}, netip.MustParseAddr("198.51.100.17"), true},
+		// An obfuscated node written by the proxy leaves the client unknown instead of trusting the nodes left of it
+		{"obfuscated by proxy", nil, []string{`for=1.2.3.4, for=unknown`}, netip.IPv4Unspecified(), true},
+		{"obfuscated behind trusted proxy", trusted, []string{`for=1.2.3.4, for=unknown, for=10.0.0.1`}, netip.IPv4Unspecified(), true},
+		{"hidden behind trusted proxy", trusted, []string{`for=1.2.3.4`, `for=_hidden;proto=https`}, netip.IPv4Unspecified(), true},
+		{"malformed behind trusted proxy", trusted, []string{`for=1.2.3.4, for="[2001:db8::1"`}, netip.IPv4Unspecified(), true},
+		{"no for", trusted, []string{`proto=https`}, netip.Addr{}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var m = &Handler{trustedProxies: c.trustedProxies}
+			got, ok := m.forwardedIP(proxiedRequest(true, "Forwarded", c.values...))
+			if ok != c.ok || got != c.want {
+				t.Errorf("forwardedIP(%q) = %v, %v, want %v, %v", c.values, got, ok, c.want, c.ok)
+			}
+		})
+	}
+
+	// The header is ignored from peers that Caddy does not trust
+	var m = &Handler{trustedProxies: trusted}
+	if got, ok := m.forwardedIP(proxiedRequest(false, "Forwarded", `for=198.51.100.17`)); ok {
+		t.Errorf("forwardedIP from an untrusted peer = %v, want none", got)
+	}
+}
+
+func TestXForwardedForIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"private_ranges"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		values []string
+		want   netip.Addr
+	}{
+		{"client", []string{`198.51.100.17`}, netip.MustParseAddr("198.51.100.17")},
+		{"client behind trusted proxies", []string{`198.51.100.17, 10.0.0.2`, `10.0.0.1`}, netip.MustParseAddr("198.51.100.17")},
+		{"spoofed entries left of client", []string{`1.2.3.4, 198.51.100.17, 10.0.0.1`}, netip.MustParseAddr("198.51.100.17")},
+		// An entry that is not an IP address leaves the client unknown instead of trusting the entries left of it
+		{"garbage behind trusted proxy", []string{`1.2.3.4, garbage, 10.0.0.1`}, netip.IPv4Unspecified()},
+		{"garbage from proxy", []string{`1.2.3.4, unknown`}, netip.IPv4Unspecified()},
+		{"empty entry", []string{`1.2.3.4, , 10.0.0.1`}, netip.IPv4Unspecified()},
+		{"garbage left of client", []string{`garbage, 198.51.100.17, 10.0.0.1`}, netip.MustParseAddr("198.51.100.17")},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var m = &Handler{trustedProxies: trusted}
+			got, ok := m.xForwardedForIP(proxiedRequest(true, "X-Forwarded-For", c.values...))
+			if !ok || got != c.want {
+				t.Errorf("xForwardedForIP(%q) = %v, %v, want %v, true", c.values, got, ok, c.want)
+			}
+		})
+	}
+}
@@ -4,7 +4,16 @@ go 1.24
 
 toolchain go1.24.4
 
-require github.com/oschwald/geoip2-golang/v2 v2.0.0-beta.3
+require (
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/maxmind/mmdbwriter v1.0.0
+	github.com/oschwald/geoip2-golang/v2 v2.0.0-beta.3
+	github.com/oschwald/maxminddb-golang/v2 v2.0.0-beta.7
+	github.com/prometheus/client_golang v1.19.1
+	go.opentelemetry.io/otel v1.31.0
+	go.opentelemetry.io/otel/trace v1.31.0
+	golang.org/x/time v0.11.0
+)
 
 require (
 	cel.dev/expr v0.19.1 // indirect
@@ -21,7 +30,7 @@ require (
 	github.com/google/pprof v0.0.0-20231212022811-ec68065c825e // indirect
 	github.com/mholt/acmez/v3 v3.1.2 // indirect
 	github.com/onsi/ginkgo/v2 v2.13.2 // indirect
-	github.com/oschwald/maxminddb-golang/v2 v2.0.0-beta.7 // indirect
+	github.com/oschwald/maxminddb-golang v1.12.0 // indirect
 	github.com/pbnjay/memory v0.0.0-20210728143218-7b4eea64cf58 // indirect
 	github.com/quic-go/qpack v0.5.1 // indirect
 	github.com/quic-go/quic-go v0.50.1 // indirect
@@ -32,9 +41,9 @@ require (
 	go.uber.org/automaxprocs v1.6.0 // indirect
 	go.uber.org/mock v0.5.0 // indirect
 	go.uber.org/zap/exp v0.3.0 // indirect
+	go4.org/netipx v0.0.0-20220812043211-3cc044ffd68d // indirect
 	golang.org/x/crypto/x509roots/fallback v0.0.0-20250305170421-49bf5b80c810 // indirect
 	golang.org/x/sync v0.12.0 // indirect
-	golang.org/x/time v0.11.0 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20241007155032-5fefd90f89a9 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20241007155032-5fefd90f89a9 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -90,7 +99,6 @@ require (
 	github.com/mitchellh/go-ps v1.0.0 // indirect
 	github.com/mitchellh/reflectwalk v1.0.2 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/prometheus/client_golang v1.19.1 // indirect
 	github.com/prometheus/client_model v0.5.0 // indirect
 	github.com/prometheus/common v0.48.0 // indirect
 	github.com/prometheus/procfs v0.12.0 // indirect
@@ -1,21 +1,234 @@
 package geoip2
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/oschwald/geoip2-golang/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// maxSubdivisions caps the number of subdivision placeholders set for a record
+const maxSubdivisions = 3
+
+// The field groups of the City record that can be decoded with fields
+const (
+	fieldsCountry  = "country"
+	fieldsCity     = "city"
+	fieldsPostal   = "postal"
+	fieldsLocation = "location"
+)
+
+const (
+	// ipSourceRemote uses the client IP as resolved by Caddy
+	ipSourceRemote = "remote"
+	// ipSourceForwarded uses the RFC 7239 Forwarded header when the request comes from a trusted proxy
+	ipSourceForwarded = "forwarded"
+)
+
+const (
+	// onMissingIPAllow serves requests without a client IP without geo data
+	onMissingIPAllow = "allow"
+	// onMissingIPDeny rejects requests without a client IP with 403
+	onMissingIPDeny = "deny"
 )
 
 type Handler struct {
 	state *GeoIp2
 	ctx   caddy.Context
+
+	// How the client IP is resolved, either remote or forwarded. Defaults to remote.
+	// forwarded is only honored for requests from one of the server's trusted_proxies.
+	IPSource string `json:"ip_source,omitempty"`
+	// Also set placeholders namespaced by the edition that answered, like geoip2.GeoLite2-City.city_name
+	EditionPlaceholders bool `json:"edition_placeholders,omitempty"`
+	// The value to set for string placeholders that could not be resolved. Defaults to an empty string
+	UnknownValue string `json:"unknown_value,omitempty"`
+	// A request path that responds with 200 if any database is available, otherwise 503.
+	// A database is unavailable when its automatic updates keep failing or it is older than max_age. Disabled by default
+	HealthPath string `json:"health_path,omitempty"`
+	// Add a geoip object with the resolved country, city and ASN to the access log. Disabled by default
+	AccessLog bool `json:"access_log,omitempty"`
+	// A request header to geolocate an IP other than the client's, as <ip>;<expiry>;<signature>.
+	// The expiry is a unix timestamp in seconds, and the signature is the hex encoded HMAC-SHA256 of <ip>|<expiry> using override_secret.
+	// Requests without a valid signature, or past the expiry, are geolocated as usual. Disabled by default
+	OverrideHeader string `json:"override_header,omitempty"`
+	// The secret used to sign override_header, supports placeholders such as {env.GEOIP_OVERRIDE_SECRET}
+	OverrideSecret string `json:"override_secret,omitempty"`
+	// A request header to geolocate an IP other than the client's, such as X-Test-IP when testing locally.
+	// Only honored when the direct peer is one of the trusted_proxies of Caddy's server. Disabled by default
+	TrustedIPHeader string `json:"trusted_ip_header,omitempty"`
+
+	// A request path that geolocates a newline or comma separated list of IPs in the request body,
+	// responding with a JSON array of results. Disabled by default
+	BatchPath string `json:"batch_path,omitempty"`
+	// The maximum number of IPs in a batch request, larger batches are rejected with 413. Defaults to 1000
+	BatchLimit int `json:"batch_limit,omitempty"`
+
+	// The fraction of requests between 0 and 1 to perform lookups for, placeholders are left empty for the others.
+	// Intended for statistical use such as analytics sampling. Defaults to 0, every request
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// What to do for requests whose client IP cannot be resolved, allow or deny with 403. Defaults to allow
+	OnMissingIP string `json:"on_missing_ip,omitempty"`
+
+	// What to do for requests from bogon addresses, either skip, block or override. Defaults to looking them up as usual
+	OnBogon string `json:"on_bogon,omitempty"`
+	// The IP to look up instead of a bogon address when on_bogon is override
+	BogonOverrideIP string `json:"bogon_override_ip,omitempty"`
+	// The prefixes considered bogons in CIDR notation, replacing the built-in list of reserved ranges
+	BogonPrefixes []string `json:"bogon_prefixes,omitempty"`
+
+	// The maximum number of lookups in flight at once. Defaults to 0, unlimited
+	MaxConcurrentLookups int `json:"max_concurrent_lookups,omitempty"`
+	// How long a request waits for a lookup when max_concurrent_lookups is reached,
+	// after which it proceeds without geo data. Defaults to 0, not waiting
+	LookupWait caddy.Duration `json:"lookup_wait,omitempty"`
+
+	// Reuse the placeholders of the previous lookup for requests from the same IP within this window,
+	// which skips the database lookups for bursts of requests from one client.
+	// The lookups of the 1024 most recent clients are kept. Defaults to 0, disabled
+	ReuseWindow caddy.Duration `json:"reuse_window,omitempty"`
+
+	// Skip the database lookups for private, loopback and link local client IPs, which public databases have no data for.
+	// Disabled by default, as a database file of internal networks can have data for them
+	SkipPrivate bool `json:"skip_private,omitempty"`
+
+	// Set geoip2.record_decode_ns to how long the database lookups took, to diagnose slow lookups. Disabled by default
+	DebugTiming bool `json:"debug_timing,omitempty"`
+
+	// Count requests by country in the geoip2_requests_by_country metric. Disabled by default
+	CountryMetrics bool `json:"country_metrics,omitempty"`
+
+	// Remember the country of each session to set geoip2.country_changed. Disabled by default
+	SessionTracking *SessionConfig `json:"session_tracking,omitempty"`
+
+	// Only decode these field groups of the City record, which reduces allocations when only some placeholders are used.
+	// One or more of country, city, postal and location. Defaults to decoding the full record
+	Fields []string `json:"fields,omitempty"`
+
+	// Add the resolved location to the request's OpenTelemetry span, if it is traced. Disabled by default
+	OTel bool `json:"otel,omitempty"`
+
+	// Proxies in these CIDR ranges are skipped when finding the client in a chain of forwarded addresses.
+	// With them, the client is also found in the X-Forwarded-For header when the direct peer is trusted by Caddy's server.
+	// private_ranges can be used as a shorthand for the private IPv4 and IPv6 ranges
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+	// The client to use when every address in a forwarded chain is a trusted proxy, either leftmost or unknown.
+	// leftmost trusts the whole chain and uses the original client. Defaults to unknown, no lookup
+	AllTrusted string `json:"all_trusted,omitempty"`
+
+	// Modules in the http.handlers.geoip2.enrichers namespace that add their own placeholders after each lookup
+	EnrichersRaw []json.RawMessage `json:"enrichers,omitempty" caddy:"namespace=http.handlers.geoip2.enrichers inline_key=enricher"`
+
+	// Overrides of the primary language by ISO country code, for countries with several official languages
+	CountryLanguages map[string]string `json:"country_languages,omitempty"`
+
+	// A response header set to the client's country code, for a CDN in front of Caddy to vary its cache on. Defaults to none
+	CacheKeyHeader string `json:"cache_key_header,omitempty"`
+	// Prefix the cache key with the continent code, like EU-DE
+	CacheKeyContinent bool `json:"cache_key_continent,omitempty"`
+
+	// Classes by ISO country code set as geoip2.rate_limit_class, for rate limiters to key on
+	RateLimitClasses map[string]string `json:"rate_limit_classes,omitempty"`
+	// The rate limit class of countries not in rate_limit_classes. Defaults to none
+	DefaultRateLimitClass string `json:"default_rate_limit_class,omitempty"`
+
+	// The language of names for this handler, overriding the locale of the geoip2 app
+	Locale string `json:"locale,omitempty"`
+	// Only consult the databases of these editions or database files, in the order of the geoip2 app. Defaults to all
+	Editions []string `json:"editions,omitempty"`
+
+	// Response headers to set by name, with values that may contain placeholders like {geoip2.country_code}.
+	// Headers whose value resolves to nothing are not set
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// A reference point to set geoip2.location_distance_km from, the distance of the client in kilometers. Defaults to none
+	DistanceFrom *Point `json:"distance_from,omitempty"`
+
+	databases      []*Database
+	overrideSecret []byte
+	lookups        chan struct{}
+	enrichers      []Enricher
+	reused         *lruCache[netip.Addr, *reusedLookup]
+	trustedProxies []netip.Prefix
+	countryCounter *prometheus.CounterVec
+	sessions       *sessionStore
+	bogons         bogons
+	bogonOverride  netip.Addr
+}
+
+// accessLogFields maps access log field names of the geoip object to the placeholders they are taken from
+var accessLogFields = []struct {
+	field       string
+	placeholder string
+}{
+	{"country_code", "geoip2.country_code"},
+	{"country_name", "geoip2.country_name"},
+	{"continent_code", "geoip2.continent_code"},
+	{"city_name", "geoip2.city_name"},
+	{"asn_system_number", "geoip2.asn_system_number"},
+	{"asn_organisation", "geoip2.asn_organisation"},
+}
+
+// varPlaceholders are copied into the request vars under the same name after a lookup
+var varPlaceholders = []string{
+	"geoip2.country_code",
+	"geoip2.country_name",
+	"geoip2.continent_code",
+	"geoip2.city_name",
+	"geoip2.postal_code",
+	"geoip2.location_timezone",
+	"geoip2.asn_system_number",
+	"geoip2.asn_organisation",
+}
+
+// stringPlaceholders are set to the configured unknown value when they are not resolved by a lookup
+var stringPlaceholders = []string{
+	"geoip2.country_code",
+	"geoip2.country_name",
+	"geoip2.continent_code",
+	"geoip2.continent_name",
+	"geoip2.city_name",
+	"geoip2.postal_code",
+	"geoip2.location_timezone",
+	"geoip2.asn_network",
+	"geoip2.asn_organisation",
+}
+
+// placeholderSetter is satisfied by *caddy.Replacer
+type placeholderSetter interface {
+	Set(variable string, value any)
+}
+
+// editionPlaceholders namespaces geoip2 placeholders by edition
+type editionPlaceholders struct {
+	repl    placeholderSetter
+	edition string
+}
+
+func (p editionPlaceholders) Set(variable string, value any) {
+	p.repl.Set(ModuleName+"."+p.edition+strings.TrimPrefix(variable, ModuleName), value)
 }
 
 func init() {
@@ -30,15 +243,26 @@ func (*Handler) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
-func (m *Handler) ClientIP(r *http.Request) (netip.Addr, error) {
+// verifyHandshake returns an error if the remote IP of r cannot be trusted yet,
+// unless the check is disabled by the geoip2 app state
+func verifyHandshake(r *http.Request, state *GeoIp2) error {
+	if state != nil && state.DisableEarlyDataCheck {
+		return nil
+	}
+
 	// if handshake is not finished, we infer 0-RTT that has
 	// not verified remote IP; could be spoofed, so we throw
 	// HTTP 425 status to tell the client to try again after
 	// the handshake is complete
 	if r.TLS != nil && !r.TLS.HandshakeComplete {
-		return netip.IPv4Unspecified(), caddyhttp.Error(http.StatusTooEarly, fmt.Errorf("TLS handshake not complete, remote IP cannot be verified"))
+		return caddyhttp.Error(http.StatusTooEarly, fmt.Errorf("TLS handshake not complete, remote IP cannot be verified"))
 	}
 
+	return nil
+}
+
+// remoteIP returns the client IP of r as resolved by Caddy
+func remoteIP(r *http.Request) (netip.Addr, error) {
 	address := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
 
 	ipStr, _, err := net.SplitHostPort(address)
@@ -61,67 +285,514 @@ func (m *Handler) ClientIP(r *http.Request) (netip.Addr, error) {
 	return ipAddr, nil
 }
 
-func (m *Handler) lookupCountry(ip netip.Addr, repl *caddy.Replacer) {
-	for _, db := range m.state.databases {
+// clientIP resolves the client IP of r the way Caddy does, used by the matchers
+func clientIP(r *http.Request, state *GeoIp2) (netip.Addr, error) {
+	if err := verifyHandshake(r, state); err != nil {
+		return netip.IPv4Unspecified(), err
+	}
+
+	return remoteIP(r)
+}
+
+func (m *Handler) ClientIP(r *http.Request) (netip.Addr, error) {
+	if err := verifyHandshake(r, m.state); err != nil {
+		return netip.IPv4Unspecified(), err
+	}
+
+	if m.OverrideHeader != "" {
+		if ipAddr, ok := m.overrideIP(r); ok {
+			return ipAddr, nil
+		}
+	}
+
+	if m.TrustedIPHeader != "" {
+		if ipAddr, ok := m.trustedHeaderIP(r); ok {
+			return ipAddr, nil
+		}
+	}
+
+	if m.IPSource == ipSourceForwarded {
+		if ipAddr, ok := m.forwardedIP(r); ok {
+			return ipAddr, nil
+		}
+	}
+
+	if len(m.trustedProxies) > 0 {
+		if ipAddr, ok := m.xForwardedForIP(r); ok {
+			return ipAddr, nil
+		}
+	}
+
+	return remoteIP(r)
+}
+
+// overrideIP returns the IP from the override header if it is signed with the override secret and has not expired
+func (m *Handler) overrideIP(r *http.Request) (netip.Addr, bool) {
+	value := r.Header.Get(m.OverrideHeader)
+	if value == "" {
+		return netip.Addr{}, false
+	}
+
+	parts := strings.Split(value, ";")
+	if len(parts) != 3 {
+		return netip.Addr{}, false
+	}
+
+	var (
+		ipStr     = strings.TrimSpace(parts[0])
+		expiryStr = strings.TrimSpace(parts[1])
+		log       = caddy.Log().Named(ModuleName)
+	)
+
+	got, err := hex.DecodeString(strings.TrimSpace(parts[2]))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	mac := hmac.New(sha256.New, m.overrideSecret)
+	mac.Write([]byte(ipStr + "|" + expiryStr))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		log.Debug("ignoring override header with an invalid signature", zap.String("header", m.OverrideHeader))
+		return netip.Addr{}, false
+	}
+
+	expiry, err := strconv.ParseInt(expiryStr, 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		log.Debug("ignoring expired override header", zap.String("header", m.OverrideHeader))
+		return netip.Addr{}, false
+	}
+
+	ipAddr, err := netip.ParseAddr(ipStr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return ipAddr, true
+}
+
+// forwardedIP resolves the client IP from the Forwarded header.
+// The right-most for= node is the one added by the trusted proxy that connected to us.
+// With trusted_proxies, the nodes added by those proxies are skipped as well.
+// An obfuscated or malformed node reached before the client leaves the client unknown.
+func (m *Handler) forwardedIP(r *http.Request) (netip.Addr, bool) {
+	if !trustedPeer(r) {
+		return netip.Addr{}, false
+	}
+
+	nodes := forwardedFor(r.Header.Values("Forwarded"))
+	if len(nodes) == 0 {
+		return netip.Addr{}, false
+	}
+
+	// Nodes that are obfuscated or malformed are kept as unknown hops, which end the chain
+	var hops = make([]netip.Addr, 0, len(nodes))
+	for _, node := range nodes {
+		addr, _ := parseNode(node)
+		hops = append(hops, addr)
+	}
+
+	if len(m.trustedProxies) == 0 {
+		hops = hops[len(hops)-1:]
+	}
+
+	return m.clientHop(hops)
+}
+
+// setPrefixLen sets the length of the network prefix that matched the lookup, records without a network are ignored
+func (m *Handler) setPrefixLen(repl placeholderSetter, network netip.Prefix) {
+	if network.IsValid() {
+		repl.Set("geoip2.match_prefix_len", network.Bits())
+	}
+}
+
+// name returns the name in the locale of the handler, or else of the geoip2 app
+func (m *Handler) name(n geoip2.Names) string {
+	if m.Locale != "" {
+		return localName(n, m.Locale)
+	}
+	return localName(n, m.state.Locale)
+}
+
+func (m *Handler) setCountry(repl placeholderSetter, rec *geoip2.Country) {
+	if !rec.HasData() {
+		return
+	}
+
+	m.setPrefixLen(repl, rec.Traits.Network)
+
+	// Some networks, like satellite providers, only have the country they are registered in
+	var country, fallback = rec.Country, false
+	if country.ISOCode == "" && rec.RegisteredCountry.ISOCode != "" {
+		country, fallback = rec.RegisteredCountry, true
+	}
+
+	repl.Set("geoip2.country_code", country.ISOCode)
+	repl.Set("geoip2.country_name", m.name(country.Names))
+	repl.Set("geoip2.country_eu", country.IsInEuropeanUnion)
+	repl.Set("geoip2.country_is_registered_fallback", fallback)
+
+	repl.Set("geoip2.continent_code", rec.Continent.Code)
+	repl.Set("geoip2.continent_name", m.name(rec.Continent.Names))
+
+	// Military and diplomatic networks represent a country other than the one they are located in
+	repl.Set("geoip2.is_represented", rec.RepresentedCountry.HasData())
+	if rec.RepresentedCountry.HasData() {
+		repl.Set("geoip2.represented_country_code", rec.RepresentedCountry.ISOCode)
+		repl.Set("geoip2.represented_country_type", rec.RepresentedCountry.Type)
+		repl.Set("geoip2.represented_country_name", m.name(rec.RepresentedCountry.Names))
+	}
+
+	// The country the IP is located in differs from where the network is registered
+	if rec.Country.ISOCode != "" && rec.RegisteredCountry.ISOCode != "" {
+		repl.Set("geoip2.country_mismatch", rec.Country.ISOCode != rec.RegisteredCountry.ISOCode)
+	}
+}
+
+func (m *Handler) lookupCountry(ip netip.Addr, repl placeholderSetter, databases []*Database, traits *networkTraits) *Database {
+	for _, db := range databases {
 		rec, err := db.Country(ip)
-		if err != nil {
+		if err != nil || !rec.HasData() {
 			continue
 		}
 
-		if rec.HasData() {
-			repl.Set("geoip2.country_code", rec.Country.ISOCode)
-			repl.Set("geoip2.country_name", rec.Country.Names.English)
-			repl.Set("geoip2.country_eu", rec.Country.IsInEuropeanUnion)
+		m.setCountry(repl, rec)
+		traits.found = true
+		traits.anycast = traits.anycast || rec.Traits.IsAnycast
 
-			repl.Set("geoip2.continent_code", rec.Continent.Code)
-			repl.Set("geoip2.content_name", rec.Continent.Names.English)
+		return db
+	}
+
+	return nil
+}
+
+func (m *Handler) setCity(repl placeholderSetter, rec *geoip2.City) {
+	if !rec.HasData() {
+		return
+	}
+
+	m.setPrefixLen(repl, rec.Traits.Network)
+
+	repl.Set("geoip2.city_name", m.name(rec.City.Names))
+	repl.Set("geoip2.postal_code", rec.Postal.Code)
+
+	// Subdivisions are ordered from the largest to the smallest, MaxMind records have at most two
+	for i, sub := range rec.Subdivisions[:min(len(rec.Subdivisions), maxSubdivisions)] {
+		repl.Set(fmt.Sprintf("geoip2.subdivisions_%d_iso_code", i+1), sub.ISOCode)
+		repl.Set(fmt.Sprintf("geoip2.subdivisions_%d_name", i+1), m.name(sub.Names))
+		repl.Set(fmt.Sprintf("geoip2.subdivisions_%d_geoname_id", i+1), sub.GeoNameID)
+	}
+	if len(rec.Subdivisions) > 0 {
+		var sub = rec.Subdivisions[len(rec.Subdivisions)-1]
+		repl.Set("geoip2.subdivision_iso_code", sub.ISOCode)
+		repl.Set("geoip2.subdivision_name", m.name(sub.Names))
+	}
+
+	if rec.Location.HasData() {
+		if lat, lon := rec.Location.Latitude, rec.Location.Longitude; lat != nil && lon != nil {
+			repl.Set("geoip2.location_latitude", *lat)
+			repl.Set("geoip2.location_longitude", *lon)
+			repl.Set("geoip2.location_geojson", geoJSONPoint(*lat, *lon))
+			if m.DistanceFrom != nil {
+				// Locations are approximate, so a tenth of a kilometer is plenty
+				repl.Set("geoip2.location_distance_km", math.Round(m.DistanceFrom.distanceKm(*lat, *lon)*10)/10)
+			}
 		}
+		repl.Set("geoip2.location_timezone", rec.Location.TimeZone)
+		if rec.Location.TimeZone != "" {
+			if loc, err := loadLocation(rec.Location.TimeZone); err == nil {
+				// The offset is evaluated now, so it follows daylight saving time
+				_, offset := time.Now().In(loc).Zone()
+				repl.Set("geoip2.location_timezone_offset_minutes", offset/60)
+			}
+		}
+		repl.Set("geoip2.location_accuracy_radius", rec.Location.AccuracyRadius)
+	}
+}
 
-		break
+// geoJSONPoint returns a GeoJSON Point geometry of a location, which lists the longitude before the latitude
+func geoJSONPoint(lat, lon float64) string {
+	return `{"type":"Point","coordinates":[` + strconv.FormatFloat(lon, 'f', -1, 64) + "," + strconv.FormatFloat(lat, 'f', -1, 64) + "]}"
+}
+
+// lookupCityFields sets the placeholders of the configured field groups, decoding only those from the City record
+func (m *Handler) lookupCityFields(ip netip.Addr, repl placeholderSetter, databases []*Database, traits *networkTraits) *Database {
+	for _, db := range databases {
+		rec, err := db.CityFields(ip, m.Fields)
+		if err != nil || !rec.HasData() {
+			continue
+		}
+
+		m.setCity(repl, rec)
+		if slices.Contains(m.Fields, fieldsCountry) {
+			m.setCountry(repl, &geoip2.Country{
+				Continent:          rec.Continent,
+				Country:            rec.Country,
+				RegisteredCountry:  rec.RegisteredCountry,
+				RepresentedCountry: rec.RepresentedCountry,
+				Traits:             geoip2.CountryTraits{Network: rec.Traits.Network},
+			})
+		}
+		traits.found = true
+
+		return db
 	}
+
+	return nil
 }
 
-func (m *Handler) lookupCity(ip netip.Addr, repl *caddy.Replacer) {
-	for _, db := range m.state.databases {
+func (m *Handler) lookupCity(ip netip.Addr, repl placeholderSetter, databases []*Database, traits *networkTraits) *Database {
+	for _, db := range databases {
 		rec, err := db.City(ip)
-		if err != nil {
+		if err != nil || !rec.HasData() {
 			continue
 		}
 
-		if rec.HasData() {
-			repl.Set("geoip2.city_name", rec.City.Names.English)
-			repl.Set("geoip2.postal_code", rec.Postal.Code)
+		m.setCity(repl, rec)
+		traits.found = true
+		traits.anycast = traits.anycast || rec.Traits.IsAnycast
+
+		return db
+	}
 
-			if rec.Location.HasData() {
-				repl.Set("geoip2.location_latitude", rec.Location.Latitude)
-				repl.Set("geoip2.location_longitude", rec.Location.Longitude)
-				repl.Set("geoip2.location_timezone", rec.Location.TimeZone)
-				repl.Set("geoip2.location_accuracy_radius", rec.Location.AccuracyRadius)
+	return nil
+}
+
+func (m *Handler) lookupEnterprise(ip netip.Addr, repl placeholderSetter, databases []*Database, traits *networkTraits) *Database {
+	for _, db := range databases {
+		rec, err := db.Enterprise(ip)
+		if err != nil || !rec.HasData() {
+			continue
+		}
+
+		// Confidences are uint8, which the replacer would otherwise render as a character
+		if rec.Country.HasData() {
+			repl.Set("geoip2.country_confidence", int(rec.Country.Confidence))
+		}
+		if rec.City.HasData() {
+			repl.Set("geoip2.city_confidence", int(rec.City.Confidence))
+		}
+		if rec.Postal.HasData() {
+			repl.Set("geoip2.postal_confidence", int(rec.Postal.Confidence))
+		}
+		for i, sub := range rec.Subdivisions[:min(len(rec.Subdivisions), maxSubdivisions)] {
+			if sub.HasData() {
+				repl.Set(fmt.Sprintf("geoip2.subdivisions_%d_confidence", i+1), int(sub.Confidence))
 			}
 		}
+		if rec.Location.HasData() {
+			repl.Set("geoip2.location_accuracy_radius", rec.Location.AccuracyRadius)
+		}
+		if rec.Traits.HasData() {
+			repl.Set("geoip2.static_ip_score", rec.Traits.StaticIPScore)
+		}
+		traits.found = true
+		traits.anycast = traits.anycast || rec.Traits.IsAnycast
+		traits.userType = rec.Traits.UserType
+		traits.asnOrg = rec.Traits.AutonomousSystemOrganization
 
-		break
+		return db
 	}
+
+	return nil
 }
 
-func (m *Handler) lookupASN(ip netip.Addr, repl *caddy.Replacer) {
-	for _, db := range m.state.databases {
+func (m *Handler) lookupASN(ip netip.Addr, repl placeholderSetter, databases []*Database, traits *networkTraits) *Database {
+	for _, db := range databases {
 		rec, err := db.ASN(ip)
+		if err != nil || !rec.HasData() {
+			continue
+		}
+
+		repl.Set("geoip2.asn_network", rec.Network.String())
+		if rec.Network.IsValid() {
+			repl.Set("geoip2.asn_network_prefix_len", rec.Network.Bits())
+		}
+		repl.Set("geoip2.asn_organisation", rec.AutonomousSystemOrganization)
+		repl.Set("geoip2.asn_system_number", rec.AutonomousSystemNumber)
+		if registry, ok := asnRegistry(rec.AutonomousSystemNumber); ok {
+			repl.Set("geoip2.asn_registry", registry)
+		}
+		traits.found = true
+		// The organization of the Enterprise edition is preferred, as it is looked up first
+		if traits.asnOrg == "" {
+			traits.asnOrg = rec.AutonomousSystemOrganization
+		}
+
+		return db
+	}
+
+	return nil
+}
+
+// lookupAnonymousIP sets the anonymizer categories that apply to ip as a sorted, comma-joined list
+func (m *Handler) lookupAnonymousIP(ip netip.Addr, repl placeholderSetter, databases []*Database, traits *networkTraits) *Database {
+	for _, db := range databases {
+		rec, err := db.AnonymousIP(ip)
 		if err != nil {
 			continue
 		}
 
-		if rec.HasData() {
-			repl.Set("geoip2.asn_network", rec.Network.String())
-			repl.Set("geoip2.asn_organisation", rec.AutonomousSystemOrganization)
-			repl.Set("geoip2.asn_system_number", rec.AutonomousSystemNumber)
+		var types []string
+		for _, t := range []struct {
+			name string
+			ok   bool
+		}{
+			{"hosting", rec.IsHostingProvider},
+			{"public_proxy", rec.IsPublicProxy},
+			{"residential_proxy", rec.IsResidentialProxy},
+			{"tor", rec.IsTorExitNode},
+			{"vpn", rec.IsAnonymousVPN},
+		} {
+			if t.ok {
+				types = append(types, t.name)
+			}
+		}
+
+		repl.Set("geoip2.anonymizer_types", strings.Join(types, ","))
+		repl.Set("geoip2.anonymous_is_anonymous", rec.IsAnonymous)
+		repl.Set("geoip2.anonymous_is_vpn", rec.IsAnonymousVPN)
+		repl.Set("geoip2.anonymous_is_hosting_provider", rec.IsHostingProvider)
+		repl.Set("geoip2.anonymous_is_public_proxy", rec.IsPublicProxy)
+		repl.Set("geoip2.anonymous_is_residential_proxy", rec.IsResidentialProxy)
+		repl.Set("geoip2.anonymous_is_tor_exit_node", rec.IsTorExitNode)
+		traits.hosting = rec.IsHostingProvider
+
+		return db
+	}
+
+	return nil
+}
+
+func (m *Handler) lookupWebService(r *http.Request, ip netip.Addr, repl placeholderSetter) {
+	rec, err := m.state.webService.City(r.Context(), ip)
+	if err != nil {
+		caddy.Log().Named(ModuleName).Debug("web service lookup failed", zap.Stringer("ip", ip), zap.Error(err))
+		return
+	}
+	if rec == nil {
+		return
+	}
+
+	m.setCity(repl, rec)
+	m.setCountry(repl, &geoip2.Country{
+		Continent:          rec.Continent,
+		Country:            rec.Country,
+		RegisteredCountry:  rec.RegisteredCountry,
+		RepresentedCountry: rec.RepresentedCountry,
+	})
+}
+
+// lookup sets placeholders from the first of databases to answer each type of lookup and returns the databases that did,
+// along with the traits of the network of ip found in the records.
+// A database without data for ip does not answer, so the next one is consulted as a fallback
+func (m *Handler) lookup(ip netip.Addr, repl placeholderSetter, databases []*Database) ([]*Database, networkTraits) {
+	var (
+		served []*Database
+		traits networkTraits
+	)
+	if len(m.Fields) > 0 {
+		served = []*Database{
+			m.lookupCityFields(ip, repl, databases, &traits),
+			m.lookupEnterprise(ip, repl, databases, &traits),
+			m.lookupASN(ip, repl, databases, &traits),
+			m.lookupAnonymousIP(ip, repl, databases, &traits),
+		}
+	} else {
+		served = []*Database{
+			m.lookupCity(ip, repl, databases, &traits),
+			m.lookupEnterprise(ip, repl, databases, &traits),
+			m.lookupCountry(ip, repl, databases, &traits),
+			m.lookupASN(ip, repl, databases, &traits),
+			m.lookupAnonymousIP(ip, repl, databases, &traits),
+		}
+	}
+
+	m.setMetadata(repl, served)
+	return served, traits
+}
+
+// setMetadata sets the build and type of the first database that served a lookup, the one the location comes from
+func (m *Handler) setMetadata(repl placeholderSetter, served []*Database) {
+	for _, db := range served {
+		if db == nil {
+			continue
+		}
+
+		md := db.Metadata()
+		repl.Set("geoip2.database_build_epoch", md.BuildEpoch)
+		repl.Set("geoip2.database_type", md.DatabaseType)
+		return
+	}
+}
+
+// setUnknown sets any unresolved string placeholders to the configured unknown value
+func (m *Handler) setUnknown(repl *caddy.Replacer) {
+	if m.UnknownValue == "" {
+		return
+	}
+
+	for _, key := range stringPlaceholders {
+		if v, ok := repl.Get(key); !ok || v == "" {
+			repl.Set(key, m.UnknownValue)
 		}
+	}
+}
+
+// sampled reports whether a lookup should be performed for the current request
+func (m *Handler) sampled() bool {
+	return m.SampleRate <= 0 || m.SampleRate >= 1 || rand.Float64() < m.SampleRate
+}
 
-		break
+// acquire takes one of the max_concurrent_lookups slots, waiting up to lookup_wait for one to be released.
+// It reports false if no slot was available, in which case the lookup should be skipped.
+func (m *Handler) acquire(r *http.Request) bool {
+	if m.lookups == nil {
+		return true
+	}
+
+	select {
+	case m.lookups <- struct{}{}:
+		return true
+	default:
+	}
+
+	if m.LookupWait <= 0 {
+		return false
+	}
+
+	var timer = time.NewTimer(time.Duration(m.LookupWait))
+	defer timer.Stop()
+
+	select {
+	case m.lookups <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// release returns a slot taken by acquire
+func (m *Handler) release() {
+	if m.lookups != nil {
+		<-m.lookups
 	}
 }
 
 func (m *Handler) bind(r *http.Request, repl *caddy.Replacer) {
+	if !m.sampled() {
+		return
+	}
+
+	if !m.acquire(r) {
+		caddy.Log().Named(ModuleName).Debug("too many concurrent lookups, skipping")
+		return
+	}
+	defer m.release()
+
+	defer m.setUnknown(repl)
+
 	clientIP, _ := m.ClientIP(r)
 
 	if clientIP.IsUnspecified() {
@@ -129,13 +800,235 @@ func (m *Handler) bind(r *http.Request, repl *caddy.Replacer) {
 		return
 	}
 
-	m.lookupCity(clientIP, repl)
-	m.lookupCountry(clientIP, repl)
-	m.lookupASN(clientIP, repl)
+	repl.Set("geoip2.ip_is_private", isPrivateIP(clientIP))
+	repl.Set("geoip2.ip_is_global", clientIP.Unmap().IsGlobalUnicast() && !isPrivateIP(clientIP))
+
+	if m.OnBogon != "" && m.bogons.contains(clientIP) {
+		switch m.OnBogon {
+		case onBogonSkip:
+			return
+		case onBogonOverride:
+			clientIP = m.bogonOverride
+		}
+	}
+
+	var (
+		log    = caddy.Log().Named(ModuleName)
+		debug  = log.Core().Enabled(zapcore.DebugLevel)
+		start  time.Time
+		served []*Database
+		reused bool
+	)
+	if m.DebugTiming || debug {
+		start = time.Now()
+	}
+
+	if !m.SkipPrivate || !isPrivateIP(clientIP) {
+		served, reused = m.lookupReusing(clientIP, repl)
+	}
+
+	var elapsed = time.Since(start)
+	if m.DebugTiming {
+		repl.Set("geoip2.record_decode_ns", elapsed.Nanoseconds())
+	}
+
+	// Fall back to the web service if no local database could resolve the country
+	if _, ok := repl.Get("geoip2.country_code"); !ok && m.state.webService != nil {
+		m.lookupWebService(r, clientIP, repl)
+	}
+
+	country, _ := repl.GetString("geoip2.country_code")
+	if m.countryCounter != nil {
+		m.countryCounter.WithLabelValues(countryLabel(country)).Inc()
+	}
+
+	if m.sessions != nil {
+		m.countryChanged(r, repl, country)
+	}
+
+	if country != "" {
+		if lang, ok := m.countryLanguage(country); ok {
+			repl.Set("geoip2.country_default_language", lang)
+		}
+	}
+
+	if class, ok := m.RateLimitClasses[country]; ok {
+		repl.Set("geoip2.rate_limit_class", class)
+	} else if m.DefaultRateLimitClass != "" {
+		repl.Set("geoip2.rate_limit_class", m.DefaultRateLimitClass)
+	}
+
+	for _, e := range m.enrichers {
+		e.Enrich(clientIP, repl)
+	}
+
+	if m.EditionPlaceholders {
+		for _, db := range m.databases {
+			m.lookup(clientIP, editionPlaceholders{repl: repl, edition: db.Edition()}, []*Database{db})
+		}
+	}
+
+	if debug {
+		ev := newLookupEvent(clientIP, repl, served)
+		log.Debug("lookup",
+			zap.String("ip", ev.IP),
+			zap.Strings("editions", ev.Editions),
+			zap.String("country", ev.Country),
+			zap.String("asn", ev.ASN),
+			zap.Bool("reused", reused),
+			zap.Duration("duration", elapsed))
+	}
+
+	if lookupTail.active() {
+		lookupTail.publish(newLookupEvent(clientIP, repl, served))
+	}
+}
+
+// available reports whether any database can be relied on for lookups
+func (m *Handler) available() bool {
+	for _, db := range m.databases {
+		if db.Available() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Handler) serveHealth(w http.ResponseWriter) error {
+	var status = http.StatusOK
+	if !m.available() {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	_, err := w.Write([]byte(http.StatusText(status)))
+	return err
+}
+
+// logFields adds the resolved data to the access log of the request
+func (m *Handler) logFields(r *http.Request, repl *caddy.Replacer) {
+	extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields)
+	if !ok {
+		return
+	}
+
+	var fields []zap.Field
+	for _, f := range accessLogFields {
+		if v, ok := repl.GetString(f.placeholder); ok && v != "" {
+			fields = append(fields, zap.String(f.field, v))
+		}
+	}
+
+	if len(fields) > 0 {
+		extra.Set(zap.Dict("geoip", fields...))
+	}
+}
+
+// setCacheKey sets the cache key header to the resolved geography, if any.
+// It is set before calling the next handler so that it is present on every response, including cached ones.
+func (m *Handler) setCacheKey(w http.ResponseWriter, repl *caddy.Replacer) {
+	country, _ := repl.GetString("geoip2.country_code")
+	if country == "" || country == m.UnknownValue {
+		return
+	}
+
+	var key = country
+	if continent, _ := repl.GetString("geoip2.continent_code"); m.CacheKeyContinent && continent != "" {
+		key = continent + "-" + country
+	}
+
+	w.Header().Set(m.CacheKeyHeader, key)
+}
+
+// setHeaders sets the configured response headers, before calling the next handler like setCacheKey
+func (m *Handler) setHeaders(w http.ResponseWriter, repl *caddy.Replacer) {
+	for name, value := range m.Headers {
+		if value = repl.ReplaceKnown(value, ""); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+}
+
+// updatePlaceholders provides geoip2.<edition>.next_update_in, the seconds until the next automatic update of an edition
+func (m *Handler) updatePlaceholders(key string) (any, bool) {
+	edition, ok := strings.CutSuffix(strings.TrimPrefix(key, ModuleName+"."), ".next_update_in")
+	if !ok {
+		return nil, false
+	}
+
+	for _, db := range m.databases {
+		if db.Edition() != edition {
+			continue
+		}
+
+		next := db.NextUpdate()
+		if next.IsZero() {
+			return nil, false
+		}
+		return max(int64(time.Until(next).Seconds()), 0), true
+	}
+
+	return nil, false
+}
+
+// setVars sets the resolved placeholders as request vars for handlers and matchers that read vars
+func (m *Handler) setVars(r *http.Request, repl *caddy.Replacer) {
+	for _, key := range varPlaceholders {
+		if v, ok := repl.Get(key); ok {
+			caddyhttp.SetVar(r.Context(), key, v)
+		}
+	}
 }
 
 func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	m.bind(r, r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer))
+	if m.HealthPath != "" && r.URL.Path == m.HealthPath {
+		return m.serveHealth(w)
+	}
+	if m.BatchPath != "" && r.URL.Path == m.BatchPath {
+		return m.serveBatch(w, r)
+	}
+
+	if m.OnMissingIP == onMissingIPDeny {
+		ip, err := m.ClientIP(r)
+		// Errors that already carry a status, such as 425 Too Early, are returned as is
+		var herr caddyhttp.HandlerError
+		if errors.As(err, &herr) {
+			return err
+		}
+		if err != nil {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("no client IP could be resolved from the request: %w", err))
+		}
+		if !ip.IsValid() || ip.IsUnspecified() {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("no client IP could be resolved from the request"))
+		}
+	}
+
+	if m.OnBogon == onBogonBlock {
+		if ip, err := m.ClientIP(r); err == nil && m.bogons.contains(ip) {
+			return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("request from bogon address %s", ip))
+		}
+	}
+
+	var repl = r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	repl.Map(m.updatePlaceholders)
+	m.bind(r, repl)
+	m.setVars(r, repl)
+
+	if m.CacheKeyHeader != "" {
+		m.setCacheKey(w, repl)
+	}
+	if len(m.Headers) > 0 {
+		m.setHeaders(w, repl)
+	}
+	if m.AccessLog {
+		m.logFields(r, repl)
+	}
+	if m.OTel {
+		m.setSpanAttributes(r, repl)
+	}
+
 	return next.ServeHTTP(w, r)
 }
 
@@ -145,22 +1038,365 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 	return &m, err
 }
 
-func (m *Handler) UnmarshalCaddyfile(_ *caddyfile.Dispenser) error {
+func (m *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "ip_source":
+			if !d.Args(&m.IPSource) {
+				return d.ArgErr()
+			}
+		case "edition_placeholders":
+			m.EditionPlaceholders = true
+		case "unknown_value":
+			if !d.Args(&m.UnknownValue) {
+				return d.ArgErr()
+			}
+		case "health_path":
+			if !d.Args(&m.HealthPath) {
+				return d.ArgErr()
+			}
+		case "access_log":
+			m.AccessLog = true
+		case "skip_private":
+			m.SkipPrivate = true
+		case "debug_timing":
+			m.DebugTiming = true
+		case "batch_path":
+			if !d.Args(&m.BatchPath) {
+				return d.ArgErr()
+			}
+		case "batch_limit":
+			var value string
+			if !d.Args(&value) {
+				return d.ArgErr()
+			}
+			BatchLimit, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid batch_limit: %v", err)
+			}
+			m.BatchLimit = BatchLimit
+		case "sample_rate":
+			var value string
+			if !d.Args(&value) {
+				return d.ArgErr()
+			}
+			SampleRate, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return d.Errf("invalid sample_rate: %v", err)
+			}
+			m.SampleRate = SampleRate
+		case "on_missing_ip":
+			if !d.Args(&m.OnMissingIP) {
+				return d.ArgErr()
+			}
+		case "on_bogon":
+			if !d.Args(&m.OnBogon) {
+				return d.ArgErr()
+			}
+			if m.OnBogon == onBogonOverride && !d.Args(&m.BogonOverrideIP) {
+				return d.ArgErr()
+			}
+		case "bogon_prefixes":
+			var prefixes = d.RemainingArgs()
+			if len(prefixes) == 0 {
+				return d.ArgErr()
+			}
+			m.BogonPrefixes = append(m.BogonPrefixes, prefixes...)
+		case "max_concurrent_lookups":
+			var args = d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			MaxConcurrentLookups, err := strconv.Atoi(args[0])
+			if err != nil {
+				return d.Errf("invalid max_concurrent_lookups: %v", err)
+			}
+			m.MaxConcurrentLookups = MaxConcurrentLookups
+			if len(args) == 2 {
+				LookupWait, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("invalid lookup wait: %v", err)
+				}
+				m.LookupWait = caddy.Duration(LookupWait)
+			}
+		case "reuse_window":
+			var value string
+			if !d.Args(&value) {
+				return d.ArgErr()
+			}
+			ReuseWindow, err := caddy.ParseDuration(value)
+			if err != nil {
+				return d.Errf("invalid reuse_window: %v", err)
+			}
+			m.ReuseWindow = caddy.Duration(ReuseWindow)
+		case "trusted_proxies":
+			var ranges = d.RemainingArgs()
+			if len(ranges) == 0 {
+				return d.ArgErr()
+			}
+			m.TrustedProxies = append(m.TrustedProxies, ranges...)
+		case "all_trusted":
+			if !d.Args(&m.AllTrusted) {
+				return d.ArgErr()
+			}
+		case "enricher":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			var name = d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "http.handlers.geoip2.enrichers."+name)
+			if err != nil {
+				return err
+			}
+			m.EnrichersRaw = append(m.EnrichersRaw, caddyconfig.JSONModuleObject(unm, "enricher", name, nil))
+		case "otel":
+			m.OTel = true
+		case "country_metrics":
+			m.CountryMetrics = true
+		case "session_tracking":
+			m.SessionTracking = new(SessionConfig)
+			err := m.SessionTracking.UnmarshalCaddyfile(d)
+			if err != nil {
+				return err
+			}
+		case "fields":
+			var fields = d.RemainingArgs()
+			if len(fields) == 0 {
+				return d.ArgErr()
+			}
+			m.Fields = append(m.Fields, fields...)
+		case "country_language":
+			var country, lang string
+			if !d.Args(&country, &lang) {
+				return d.ArgErr()
+			}
+			if m.CountryLanguages == nil {
+				m.CountryLanguages = make(map[string]string)
+			}
+			m.CountryLanguages[strings.ToUpper(country)] = lang
+		case "cache_key_header":
+			var args = d.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			m.CacheKeyHeader = args[0]
+			if len(args) == 2 {
+				if args[1] != "continent" {
+					return d.Errf("unknown cache_key_header option %q", args[1])
+				}
+				m.CacheKeyContinent = true
+			}
+		case "rate_limit_class":
+			var args = d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			if m.RateLimitClasses == nil {
+				m.RateLimitClasses = make(map[string]string)
+			}
+			for _, country := range args[1:] {
+				m.RateLimitClasses[strings.ToUpper(country)] = args[0]
+			}
+		case "default_rate_limit_class":
+			if !d.Args(&m.DefaultRateLimitClass) {
+				return d.ArgErr()
+			}
+		case "override_header":
+			if !d.Args(&m.OverrideHeader, &m.OverrideSecret) {
+				return d.ArgErr()
+			}
+		case "trusted_ip_header":
+			if !d.Args(&m.TrustedIPHeader) {
+				return d.ArgErr()
+			}
+		case "locale":
+			if !d.Args(&m.Locale) {
+				return d.ArgErr()
+			}
+		case "editions":
+			var editions = d.RemainingArgs()
+			if len(editions) == 0 {
+				return d.ArgErr()
+			}
+			m.Editions = append(m.Editions, editions...)
+		case "headers":
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				var name, value = d.Val(), ""
+				if !d.Args(&value) {
+					return d.ArgErr()
+				}
+				if m.Headers == nil {
+					m.Headers = make(map[string]string)
+				}
+				m.Headers[name] = value
+			}
+		case "distance_from":
+			var lat, lon string
+			if !d.Args(&lat, &lon) {
+				return d.ArgErr()
+			}
+			DistanceFrom, err := parsePoint(lat, lon)
+			if err != nil {
+				return d.Errf("invalid distance_from: %v", err)
+			}
+			m.DistanceFrom = &DistanceFrom
+		default:
+			return d.Errf("unknown geoip2 handler option %q", d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
 	return nil
 }
 
 func (m *Handler) Provision(ctx caddy.Context) error {
 	caddy.Log().Named("http.handlers.geoip2").Info(fmt.Sprintf("Provision"))
-	app, err := ctx.App(ModuleName)
+	state, err := geoip2App(ctx)
 	if err != nil {
-		return fmt.Errorf("getting geoip2 app: %v", err)
+		return err
 	}
-	m.state = app.(*GeoIp2)
+	m.state = state
 	m.ctx = ctx
+
+	m.databases = state.databases
+	if len(m.Editions) > 0 {
+		m.databases = nil
+		for _, db := range state.databases {
+			if slices.Contains(m.Editions, db.Edition()) {
+				m.databases = append(m.databases, db)
+			}
+		}
+		for _, edition := range m.Editions {
+			if !slices.ContainsFunc(m.databases, func(db *Database) bool { return db.Edition() == edition }) {
+				return fmt.Errorf("edition %s is not loaded by the geoip2 app", edition)
+			}
+		}
+	}
+
+	if m.BatchLimit == 0 {
+		m.BatchLimit = 1000
+	}
+
+	var prefixes = m.BogonPrefixes
+	if len(prefixes) == 0 {
+		prefixes = defaultBogonPrefixes
+	}
+	m.bogons, err = parseBogons(prefixes)
+	if err != nil {
+		return err
+	}
+
+	if m.OnBogon == onBogonOverride {
+		m.bogonOverride, err = netip.ParseAddr(m.BogonOverrideIP)
+		if err != nil {
+			return fmt.Errorf("invalid bogon_override_ip: %w", err)
+		}
+	}
+
+	if m.CountryMetrics {
+		m.countryCounter, err = registerCounter(ctx.GetMetricsRegistry(), newCountryRequests())
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.SessionTracking != nil {
+		m.sessions = newSessionStore(m.SessionTracking)
+	}
+
+	if m.EnrichersRaw != nil {
+		mods, err := ctx.LoadModule(m, "EnrichersRaw")
+		if err != nil {
+			return fmt.Errorf("loading enrichers: %v", err)
+		}
+		for _, mod := range mods.([]any) {
+			e, ok := mod.(Enricher)
+			if !ok {
+				return fmt.Errorf("module %T is not a geoip2 enricher", mod)
+			}
+			m.enrichers = append(m.enrichers, e)
+		}
+	}
+
+	m.trustedProxies, err = parseTrustedProxies(m.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	if m.MaxConcurrentLookups > 0 {
+		m.lookups = make(chan struct{}, m.MaxConcurrentLookups)
+	}
+
+	if m.ReuseWindow > 0 {
+		m.reused = newLRUCache[netip.Addr, *reusedLookup](reuseCacheSize)
+	}
+
+	if m.OverrideHeader != "" {
+		m.overrideSecret = []byte(caddy.NewReplacer().ReplaceKnown(m.OverrideSecret, ""))
+	}
+
 	return nil
 }
 func (m *Handler) Validate() error {
-	caddy.Log().Named("http.handlers.geoip2").Info(fmt.Sprintf("Validate"))
+	switch m.IPSource {
+	case "", ipSourceRemote, ipSourceForwarded:
+	default:
+		return fmt.Errorf("unknown ip_source %q", m.IPSource)
+	}
+
+	switch m.AllTrusted {
+	case "", allTrustedLeftmost, allTrustedUnknown:
+	default:
+		return fmt.Errorf("unknown all_trusted %q", m.AllTrusted)
+	}
+
+	switch m.OnMissingIP {
+	case "", onMissingIPAllow, onMissingIPDeny:
+	default:
+		return fmt.Errorf("unknown on_missing_ip %q", m.OnMissingIP)
+	}
+
+	switch m.OnBogon {
+	case "", onBogonSkip, onBogonBlock, onBogonOverride:
+	default:
+		return fmt.Errorf("unknown on_bogon %q", m.OnBogon)
+	}
+
+	if m.SampleRate < 0 || m.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1, got %v", m.SampleRate)
+	}
+
+	for _, field := range m.Fields {
+		switch field {
+		case fieldsCountry, fieldsCity, fieldsPostal, fieldsLocation:
+		default:
+			return fmt.Errorf("unknown field group %q", field)
+		}
+	}
+
+	if m.SessionTracking != nil && m.SessionTracking.Cookie == "" && m.SessionTracking.Header == "" {
+		return fmt.Errorf("session_tracking requires a cookie or header")
+	}
+
+	if m.OverrideHeader != "" && len(m.overrideSecret) == 0 {
+		return fmt.Errorf("override_header requires a non-empty override_secret")
+	}
+
+	if m.Locale != "" {
+		if err := validLocale(m.Locale); err != nil {
+			return err
+		}
+	}
+
+	if m.DistanceFrom != nil {
+		if err := m.DistanceFrom.validate(); err != nil {
+			return fmt.Errorf("invalid distance_from: %v", err)
+		}
+	}
+
 	return nil
 }
 
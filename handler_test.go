@@ -0,0 +1,281 @@
+package geoip2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang/v2/mmdbdata"
+)
+
+// newTestHandler returns a handler looking up in databases, as if provisioned with the defaults
+func newTestHandler(databases ...*Database) *Handler {
+	return &Handler{
+		state:     &GeoIp2{Locale: "en", databases: databases},
+		databases: databases,
+	}
+}
+
+// lookupPlaceholders looks up ip with m and returns the resulting placeholders
+func lookupPlaceholders(m *Handler, ip string) *caddy.Replacer {
+	var repl = caddy.NewReplacer()
+	m.lookup(netip.MustParseAddr(ip), repl, m.databases)
+	return repl
+}
+
+// panicking panics when a record is decoded into it
+type panicking struct{}
+
+func (*panicking) UnmarshalMaxMindDB(*mmdbdata.Decoder) error {
+	panic("malformed record")
+}
+
+func TestMalformedRecord(t *testing.T) {
+	var db = openDatabase(t, "GeoLite2-City", writeDatabase(t, "GeoLite2-City", map[string]mmdbtype.Map{
+		// Names and locations of the wrong type fail to decode into a City record
+		"81.2.69.0/24": {
+			"city":     mmdbtype.String("London"),
+			"country":  mmdbtype.Map{"iso_code": mmdbtype.Uint32(826)},
+			"location": mmdbtype.Map{"latitude": mmdbtype.String("north")},
+		},
+	}), OpenOptions{})
+
+	var m = newTestHandler(db)
+	m.UnknownValue = "unknown"
+
+	var repl = lookupPlaceholders(m, "81.2.69.1")
+	m.setUnknown(repl)
+	for _, key := range []string{"geoip2.country_code", "geoip2.city_name"} {
+		if v, _ := repl.GetString(key); v != "unknown" {
+			t.Errorf("%s = %q, want unknown", key, v)
+		}
+	}
+
+	// A panic while decoding is returned as an error
+	if err := db.LookupRaw(netip.MustParseAddr("81.2.69.1"), new(panicking)); err == nil {
+		t.Error("LookupRaw of a panicking record returned no error")
+	}
+}
+
+func TestGeoIP2City(t *testing.T) {
+	var db = openDatabase(t, "GeoIP2-City", writeDatabase(t, "GeoIP2-City", map[string]mmdbtype.Map{
+		"81.2.69.0/24": {
+			"city":         mmdbtype.Map{"names": names("London")},
+			"continent":    mmdbtype.Map{"code": mmdbtype.String("EU"), "names": names("Europe")},
+			"country":      mmdbtype.Map{"iso_code": mmdbtype.String("GB"), "names": names("United Kingdom")},
+			"postal":       mmdbtype.Map{"code": mmdbtype.String("EC2V")},
+			"subdivisions": mmdbtype.Slice{mmdbtype.Map{"iso_code": mmdbtype.String("ENG"), "names": names("England")}},
+		},
+	}), OpenOptions{})
+
+	if !knownEdition("GeoIP2-City") {
+		t.Error("GeoIP2-City is not a known edition")
+	}
+	if !typeMatchesEdition(db.DatabaseType(), "GeoIP2-City") {
+		t.Errorf("database type %s does not match GeoIP2-City", db.DatabaseType())
+	}
+
+	var repl = lookupPlaceholders(newTestHandler(db), "81.2.69.1")
+	for key, want := range map[string]string{
+		"geoip2.city_name":            "London",
+		"geoip2.country_code":         "GB",
+		"geoip2.postal_code":          "EC2V",
+		"geoip2.subdivision_iso_code": "ENG",
+		"geoip2.database_type":        "GeoIP2-City",
+	} {
+		if v, _ := repl.GetString(key); v != want {
+			t.Errorf("%s = %q, want %q", key, v, want)
+		}
+	}
+}
+
+func TestCountryContinent(t *testing.T) {
+	var db = openDatabase(t, "GeoLite2-Country", writeDatabase(t, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"81.2.69.0/24": {
+			"continent": mmdbtype.Map{"code": mmdbtype.String("EU"), "names": names("Europe")},
+			"country":   mmdbtype.Map{"iso_code": mmdbtype.String("GB"), "names": names("United Kingdom")},
+		},
+	}), OpenOptions{})
+
+	var repl = lookupPlaceholders(newTestHandler(db), "81.2.69.1")
+	for key, want := range map[string]string{
+		"geoip2.continent_code": "EU",
+		"geoip2.continent_name": "Europe",
+		"geoip2.country_code":   "GB",
+		"geoip2.country_name":   "United Kingdom",
+	} {
+		if v, _ := repl.GetString(key); v != want {
+			t.Errorf("%s = %q, want %q", key, v, want)
+		}
+	}
+	if _, ok := repl.Get("geoip2.content_name"); ok {
+		t.Error("geoip2.content_name is set")
+	}
+}
+
+func TestEnterpriseConfidence(t *testing.T) {
+	var db = openDatabase(t, "GeoIP2-Enterprise", writeDatabase(t, "GeoIP2-Enterprise", map[string]mmdbtype.Map{
+		"81.2.69.0/24": {
+			"city":    mmdbtype.Map{"names": names("London"), "confidence": mmdbtype.Uint16(50)},
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String("GB"), "confidence": mmdbtype.Uint16(99)},
+			"postal":  mmdbtype.Map{"code": mmdbtype.String("EC2V"), "confidence": mmdbtype.Uint16(5)},
+			"subdivisions": mmdbtype.Slice{
+				mmdbtype.Map{"iso_code": mmdbtype.String("ENG"), "confidence": mmdbtype.Uint16(80)},
+			},
+		},
+	}), OpenOptions{})
+
+	var repl = lookupPlaceholders(newTestHandler(db), "81.2.69.1")
+	for key, want := range map[string]string{
+		"geoip2.country_confidence":        "99",
+		"geoip2.city_confidence":           "50",
+		"geoip2.postal_confidence":         "5",
+		"geoip2.subdivisions_1_confidence": "80",
+	} {
+		if v, _ := repl.GetString(key); v != want {
+			t.Errorf("%s = %q, want %q", key, v, want)
+		}
+	}
+}
+
+func TestEnterpriseStaticIPScore(t *testing.T) {
+	var db = openDatabase(t, "GeoIP2-Enterprise", writeDatabase(t, "GeoIP2-Enterprise", map[string]mmdbtype.Map{
+		"81.2.69.0/24": {
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String("GB")},
+			"traits":  mmdbtype.Map{"static_ip_score": mmdbtype.Float64(1.5)},
+		},
+		// Records without traits have no static IP score
+		"5.6.7.0/24": {
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String("DE")},
+		},
+	}), OpenOptions{})
+
+	var m = newTestHandler(db)
+	if v, _ := lookupPlaceholders(m, "81.2.69.1").GetString("geoip2.static_ip_score"); v != "1.5" {
+		t.Errorf("geoip2.static_ip_score = %q, want 1.5", v)
+	}
+	if _, ok := lookupPlaceholders(m, "5.6.7.8").Get("geoip2.static_ip_score"); ok {
+		t.Error("geoip2.static_ip_score is set for a record without traits")
+	}
+
+	// Databases other than Enterprise have no static IP score
+	m = newTestHandler(openDatabase(t, "GeoLite2-City", cityDatabase(t), OpenOptions{}))
+	if _, ok := lookupPlaceholders(m, "81.2.69.1").Get("geoip2.static_ip_score"); ok {
+		t.Error("geoip2.static_ip_score is set for a City database")
+	}
+}
+
+func TestServeHealth(t *testing.T) {
+	var (
+		filePath = cityDatabase(t)
+		healthy  = openDatabase(t, "GeoLite2-City", filePath, OpenOptions{})
+		// Automatic updates have been failing for longer than twice the update frequency
+		failing = openDatabase(t, "GeoLite2-City", filePath, OpenOptions{})
+		// The database build is older than max_age
+		stale = openDatabase(t, "GeoLite2-City", filePath, OpenOptions{})
+	)
+	failing.updater = func() error { return nil }
+	failing.updateEvery = time.Hour
+	failing.lastSuccessfulUpdate.Store(time.Now().Add(-3 * time.Hour).UnixNano())
+	stale.maxAge = time.Nanosecond
+
+	for _, c := range []struct {
+		name      string
+		databases []*Database
+		want      int
+	}{
+		{"healthy", []*Database{healthy}, http.StatusOK},
+		{"failing updates", []*Database{failing}, http.StatusServiceUnavailable},
+		{"stale", []*Database{stale}, http.StatusServiceUnavailable},
+		{"all unavailable", []*Database{failing, stale}, http.StatusServiceUnavailable},
+		{"any available", []*Database{failing, healthy}, http.StatusOK},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var w = httptest.NewRecorder()
+			if err := newTestHandler(c.databases...).serveHealth(w); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != c.want {
+				t.Errorf("status = %d, want %d", w.Code, c.want)
+			}
+		})
+	}
+}
+
+func TestSkipPrivate(t *testing.T) {
+	// A database of internal networks has data for private addresses
+	var db = openDatabase(t, "GeoLite2-Country", writeDatabase(t, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"10.0.0.0/8": {"country": mmdbtype.Map{"iso_code": mmdbtype.String("GB")}},
+	}), OpenOptions{})
+
+	for _, c := range []struct {
+		skip bool
+		want string
+	}{
+		{false, "GB"},
+		{true, ""},
+	} {
+		var (
+			m    = newTestHandler(db)
+			repl = caddy.NewReplacer()
+		)
+		m.SkipPrivate = c.skip
+		m.bind(matchRequest("10.1.2.3"), repl)
+
+		if v, _ := repl.GetString("geoip2.country_code"); v != c.want {
+			t.Errorf("skip_private %t: geoip2.country_code = %q, want %q", c.skip, v, c.want)
+		}
+		if v, _ := repl.Get("geoip2.ip_is_private"); v != true {
+			t.Errorf("skip_private %t: geoip2.ip_is_private = %v, want true", c.skip, v)
+		}
+	}
+}
+
+func TestOverrideIP(t *testing.T) {
+	var (
+		m      = &Handler{OverrideHeader: "X-GeoIP-Override", overrideSecret: []byte("secret")}
+		hexMAC = func(secret, payload string) string {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(payload))
+			return hex.EncodeToString(mac.Sum(nil))
+		}
+		sign = func(secret, ip string, expiry time.Time) string {
+			var exp = strconv.FormatInt(expiry.Unix(), 10)
+			return ip + ";" + exp + ";" + hexMAC(secret, ip+"|"+exp)
+		}
+		later   = time.Now().Add(time.Hour)
+		earlier = time.Now().Add(-time.Minute)
+	)
+
+	for _, c := range []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"valid", sign("secret", "1.2.3.4", later), true},
+		{"expired", sign("secret", "1.2.3.4", earlier), false},
+		{"wrong secret", sign("other", "1.2.3.4", later), false},
+		{"extended expiry", strings.Replace(sign("secret", "1.2.3.4", earlier), strconv.FormatInt(earlier.Unix(), 10), strconv.FormatInt(later.Unix(), 10), 1), false},
+		// Signatures of the IP alone never expire, so are no longer accepted
+		{"signed without expiry", "1.2.3.4;" + hexMAC("secret", "1.2.3.4"), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ip, ok := m.overrideIP(proxiedRequest(false, m.OverrideHeader, c.value))
+			if ok != c.want {
+				t.Fatalf("overrideIP() ok = %t, want %t", ok, c.want)
+			}
+			if ok && ip != netip.MustParseAddr("1.2.3.4") {
+				t.Errorf("overrideIP() = %s, want 1.2.3.4", ip)
+			}
+		})
+	}
+}
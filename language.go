@@ -0,0 +1,46 @@
+package geoip2
+
+// countryLanguages maps ISO 3166-1 country codes to the ISO 639-1 code of their primary language.
+// Countries with several official languages use the one most widely spoken, which can be overridden with country_language.
+var countryLanguages = map[string]string{
+	"AD": "ca", "AE": "ar", "AF": "ps", "AG": "en", "AI": "en", "AL": "sq", "AM": "hy", "AO": "pt",
+	"AR": "es", "AS": "en", "AT": "de", "AU": "en", "AW": "nl", "AX": "sv", "AZ": "az", "BA": "bs",
+	"BB": "en", "BD": "bn", "BE": "nl", "BF": "fr", "BG": "bg", "BH": "ar", "BI": "rn", "BJ": "fr",
+	"BL": "fr", "BM": "en", "BN": "ms", "BO": "es", "BQ": "nl", "BR": "pt", "BS": "en", "BT": "dz",
+	"BW": "en", "BY": "be", "BZ": "en", "CA": "en", "CD": "fr", "CF": "fr", "CG": "fr", "CH": "de",
+	"CI": "fr", "CK": "en", "CL": "es", "CM": "fr", "CN": "zh", "CO": "es", "CR": "es", "CU": "es",
+	"CV": "pt", "CW": "nl", "CY": "el", "CZ": "cs", "DE": "de", "DJ": "fr", "DK": "da", "DM": "en",
+	"DO": "es", "DZ": "ar", "EC": "es", "EE": "et", "EG": "ar", "EH": "ar", "ER": "ti", "ES": "es",
+	"ET": "am", "FI": "fi", "FJ": "en", "FK": "en", "FM": "en", "FO": "fo", "FR": "fr", "GA": "fr",
+	"GB": "en", "GD": "en", "GE": "ka", "GF": "fr", "GG": "en", "GH": "en", "GI": "en", "GL": "kl",
+	"GM": "en", "GN": "fr", "GP": "fr", "GQ": "es", "GR": "el", "GT": "es", "GU": "en", "GW": "pt",
+	"GY": "en", "HK": "zh", "HN": "es", "HR": "hr", "HT": "fr", "HU": "hu", "ID": "id", "IE": "en",
+	"IL": "he", "IM": "en", "IN": "hi", "IQ": "ar", "IR": "fa", "IS": "is", "IT": "it", "JE": "en",
+	"JM": "en", "JO": "ar", "JP": "ja", "KE": "sw", "KG": "ky", "KH": "km", "KI": "en", "KM": "ar",
+	"KN": "en", "KP": "ko", "KR": "ko", "KW": "ar", "KY": "en", "KZ": "kk", "LA": "lo", "LB": "ar",
+	"LC": "en", "LI": "de", "LK": "si", "LR": "en", "LS": "en", "LT": "lt", "LU": "lb", "LV": "lv",
+	"LY": "ar", "MA": "ar", "MC": "fr", "MD": "ro", "ME": "sr", "MF": "fr", "MG": "mg", "MH": "mh",
+	"MK": "mk", "ML": "fr", "MM": "my", "MN": "mn", "MO": "zh", "MP": "en", "MQ": "fr", "MR": "ar",
+	"MS": "en", "MT": "mt", "MU": "en", "MV": "dv", "MW": "en", "MX": "es", "MY": "ms", "MZ": "pt",
+	"NA": "en", "NC": "fr", "NE": "fr", "NG": "en", "NI": "es", "NL": "nl", "NO": "nb", "NP": "ne",
+	"NR": "na", "NU": "en", "NZ": "en", "OM": "ar", "PA": "es", "PE": "es", "PF": "fr", "PG": "en",
+	"PH": "fil", "PK": "ur", "PL": "pl", "PM": "fr", "PR": "es", "PS": "ar", "PT": "pt", "PW": "en",
+	"PY": "es", "QA": "ar", "RE": "fr", "RO": "ro", "RS": "sr", "RU": "ru", "RW": "rw", "SA": "ar",
+	"SB": "en", "SC": "fr", "SD": "ar", "SE": "sv", "SG": "en", "SH": "en", "SI": "sl", "SK": "sk",
+	"SL": "en", "SM": "it", "SN": "fr", "SO": "so", "SR": "nl", "SS": "en", "ST": "pt", "SV": "es",
+	"SX": "nl", "SY": "ar", "SZ": "en", "TC": "en", "TD": "fr", "TG": "fr", "TH": "th", "TJ": "tg",
+	"TL": "pt", "TM": "tk", "TN": "ar", "TO": "to", "TR": "tr", "TT": "en", "TV": "en", "TW": "zh",
+	"TZ": "sw", "UA": "uk", "UG": "en", "US": "en", "UY": "es", "UZ": "uz", "VA": "it", "VC": "en",
+	"VE": "es", "VG": "en", "VI": "en", "VN": "vi", "VU": "bi", "WF": "fr", "WS": "sm", "XK": "sq",
+	"YE": "ar", "YT": "fr", "ZA": "en", "ZM": "en", "ZW": "en",
+}
+
+// countryLanguage returns the primary language of country, preferring the configured overrides
+func (m *Handler) countryLanguage(country string) (string, bool) {
+	if lang, ok := m.CountryLanguages[country]; ok {
+		return lang, true
+	}
+
+	lang, ok := countryLanguages[country]
+	return lang, ok
+}
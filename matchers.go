@@ -0,0 +1,714 @@
+package geoip2
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(new(MatchLocalTime))
+	caddy.RegisterModule(new(MatchTimeZone))
+	caddy.RegisterModule(new(MatchBoundingBox))
+	caddy.RegisterModule(new(MatchCountry))
+	caddy.RegisterModule(new(MatchASNOrg))
+	caddy.RegisterModule(new(MatchASN))
+	caddy.RegisterModule(new(MatchProximity))
+}
+
+// locations caches loaded time zones by IANA name
+var locations sync.Map
+
+// loadLocation loads an IANA time zone, caching the result
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// geoip2App returns the provisioned geoip2 app
+func geoip2App(ctx caddy.Context) (*GeoIp2, error) {
+	app, err := ctx.App(ModuleName)
+	if err != nil {
+		return nil, fmt.Errorf("getting geoip2 app: %v", err)
+	}
+	return app.(*GeoIp2), nil
+}
+
+// MatchLocalTime matches when the local time of the client, in the time zone of their resolved location,
+// is within a daily window. The window may wrap around midnight, like 22:00 to 06:00.
+//
+//	geoip2_localtime <from> <to>
+type MatchLocalTime struct {
+	state *GeoIp2
+	from  time.Duration
+	to    time.Duration
+
+	// The start of the window, inclusive, as HH:MM
+	From string `json:"from,omitempty"`
+	// The end of the window, exclusive, as HH:MM
+	To string `json:"to,omitempty"`
+	// Whether to match when the client's time zone cannot be resolved. Defaults to false
+	Default bool `json:"default,omitempty"`
+}
+
+func (*MatchLocalTime) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_localtime",
+		New: func() caddy.Module { return new(MatchLocalTime) },
+	}
+}
+
+func (m *MatchLocalTime) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume matcher name
+	d.Args(&m.From, &m.To)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "from":
+			if !d.Args(&m.From) {
+				return d.ArgErr()
+			}
+		case "to":
+			if !d.Args(&m.To) {
+				return d.ArgErr()
+			}
+		case "default":
+			m.Default = true
+		default:
+			return d.Errf("unknown geoip2_localtime option %q", d.Val())
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
+
+// parseTimeOfDay parses HH:MM into the duration since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (m *MatchLocalTime) Provision(ctx caddy.Context) error {
+	var err error
+	m.from, err = parseTimeOfDay(m.From)
+	if err != nil {
+		return err
+	}
+	m.to, err = parseTimeOfDay(m.To)
+	if err != nil {
+		return err
+	}
+
+	m.state, err = geoip2App(ctx)
+	return err
+}
+
+func (m *MatchLocalTime) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+func (m *MatchLocalTime) MatchWithError(r *http.Request) (bool, error) {
+	ip, err := clientIP(r, m.state)
+	if err != nil {
+		return false, err
+	}
+
+	rec, err := m.state.LookupCity(ip)
+	if err != nil || rec.Location.TimeZone == "" {
+		return m.Default, nil
+	}
+
+	loc, err := loadLocation(rec.Location.TimeZone)
+	if err != nil {
+		return m.Default, nil
+	}
+
+	return m.within(time.Now().In(loc)), nil
+}
+
+// within reports whether the time of day of t is within the window
+func (m *MatchLocalTime) within(t time.Time) bool {
+	var sinceMidnight = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+
+	if m.from <= m.to {
+		return sinceMidnight >= m.from && sinceMidnight < m.to
+	}
+
+	// The window wraps around midnight
+	return sinceMidnight >= m.from || sinceMidnight < m.to
+}
+
+// MatchTimeZone matches when the time zone of the client's resolved location is one of the given IANA time zones.
+// Clients without a known time zone never match.
+//
+//	geoip2_timezone <time_zones...>
+type MatchTimeZone struct {
+	state *GeoIp2
+
+	// The IANA time zones to match, like Europe/Berlin
+	TimeZones []string `json:"time_zones,omitempty"`
+}
+
+func (*MatchTimeZone) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_timezone",
+		New: func() caddy.Module { return new(MatchTimeZone) },
+	}
+}
+
+func (m *MatchTimeZone) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		var timeZones = d.RemainingArgs()
+		if len(timeZones) == 0 {
+			return d.ArgErr()
+		}
+		m.TimeZones = append(m.TimeZones, timeZones...)
+	}
+
+	return nil
+}
+
+func (m *MatchTimeZone) Provision(ctx caddy.Context) error {
+	var err error
+	m.state, err = geoip2App(ctx)
+	return err
+}
+
+func (m *MatchTimeZone) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+func (m *MatchTimeZone) MatchWithError(r *http.Request) (bool, error) {
+	ip, err := clientIP(r, m.state)
+	if err != nil {
+		return false, err
+	}
+
+	rec, err := m.state.LookupCity(ip)
+	if err != nil || rec.Location.TimeZone == "" {
+		return false, nil
+	}
+
+	return slices.Contains(m.TimeZones, rec.Location.TimeZone), nil
+}
+
+// MatchBoundingBox matches when the client's resolved coordinates are within a rectangle of latitude and longitude.
+// The box may cross the antimeridian, in which case min_lon is greater than max_lon.
+//
+//	geoip2_bbox {
+//		min_lat <degrees>
+//		max_lat <degrees>
+//		min_lon <degrees>
+//		max_lon <degrees>
+//	}
+type MatchBoundingBox struct {
+	state *GeoIp2
+
+	// The southern edge of the box, inclusive. Required
+	MinLat *float64 `json:"min_lat"`
+	// The northern edge of the box, inclusive. Required
+	MaxLat *float64 `json:"max_lat"`
+	// The western edge of the box, inclusive. Required
+	MinLon *float64 `json:"min_lon"`
+	// The eastern edge of the box, inclusive. Required
+	MaxLon *float64 `json:"max_lon"`
+	// Whether to match when the client's coordinates cannot be resolved. Defaults to false
+	Default bool `json:"default,omitempty"`
+}
+
+func (*MatchBoundingBox) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_bbox",
+		New: func() caddy.Module { return new(MatchBoundingBox) },
+	}
+}
+
+func (m *MatchBoundingBox) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume matcher name
+
+	for d.NextBlock(0) {
+		var key = d.Val()
+		if key == "default" {
+			m.Default = true
+			continue
+		}
+
+		var value string
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		degrees, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return d.Errf("invalid %s: %v", key, err)
+		}
+
+		switch key {
+		case "min_lat":
+			m.MinLat = &degrees
+		case "max_lat":
+			m.MaxLat = &degrees
+		case "min_lon":
+			m.MinLon = &degrees
+		case "max_lon":
+			m.MaxLon = &degrees
+		default:
+			return d.Errf("unknown geoip2_bbox option %q", key)
+		}
+	}
+
+	return nil
+}
+
+func (m *MatchBoundingBox) Provision(ctx caddy.Context) error {
+	var err error
+	m.state, err = geoip2App(ctx)
+	return err
+}
+
+func (m *MatchBoundingBox) Validate() error {
+	if m.MinLat == nil || m.MaxLat == nil || m.MinLon == nil || m.MaxLon == nil {
+		return fmt.Errorf("geoip2_bbox requires min_lat, max_lat, min_lon and max_lon")
+	}
+	if *m.MinLat < -90 || *m.MaxLat > 90 || *m.MinLat > *m.MaxLat {
+		return fmt.Errorf("invalid geoip2_bbox latitude range %v to %v", *m.MinLat, *m.MaxLat)
+	}
+	if *m.MinLon < -180 || *m.MinLon > 180 || *m.MaxLon < -180 || *m.MaxLon > 180 {
+		return fmt.Errorf("invalid geoip2_bbox longitude range %v to %v", *m.MinLon, *m.MaxLon)
+	}
+
+	return nil
+}
+
+func (m *MatchBoundingBox) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+func (m *MatchBoundingBox) MatchWithError(r *http.Request) (bool, error) {
+	ip, err := clientIP(r, m.state)
+	if err != nil {
+		return false, err
+	}
+
+	lat, lon, ok := m.state.coordinates(ip)
+	if !ok {
+		return m.Default, nil
+	}
+
+	if lat < *m.MinLat || lat > *m.MaxLat {
+		return false, nil
+	}
+
+	if *m.MinLon <= *m.MaxLon {
+		return lon >= *m.MinLon && lon <= *m.MaxLon, nil
+	}
+
+	// The box crosses the antimeridian
+	return lon >= *m.MinLon || lon <= *m.MaxLon, nil
+}
+
+// MatchProximity matches when the client's resolved location is within a radius of a point.
+// Clients without a known location never match.
+//
+//	geoip2_proximity <lat> <lon> <radius_km>
+type MatchProximity struct {
+	state *GeoIp2
+
+	// The center of the circle
+	Center Point `json:"center"`
+	// The radius of the circle in kilometers, inclusive
+	RadiusKm float64 `json:"radius_km"`
+}
+
+func (*MatchProximity) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_proximity",
+		New: func() caddy.Module { return new(MatchProximity) },
+	}
+}
+
+func (m *MatchProximity) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume matcher name
+
+	var lat, lon, radius string
+	if !d.Args(&lat, &lon, &radius) || d.NextArg() {
+		return d.ArgErr()
+	}
+
+	center, err := parsePoint(lat, lon)
+	if err != nil {
+		return d.Errf("invalid geoip2_proximity center: %v", err)
+	}
+	RadiusKm, err := strconv.ParseFloat(radius, 64)
+	if err != nil {
+		return d.Errf("invalid geoip2_proximity radius: %v", err)
+	}
+
+	m.Center = center
+	m.RadiusKm = RadiusKm
+	return nil
+}
+
+func (m *MatchProximity) Provision(ctx caddy.Context) error {
+	var err error
+	m.state, err = geoip2App(ctx)
+	return err
+}
+
+func (m *MatchProximity) Validate() error {
+	if err := m.Center.validate(); err != nil {
+		return fmt.Errorf("invalid geoip2_proximity center: %v", err)
+	}
+	if m.RadiusKm <= 0 {
+		return fmt.Errorf("geoip2_proximity radius must be positive, got %v", m.RadiusKm)
+	}
+
+	return nil
+}
+
+func (m *MatchProximity) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+func (m *MatchProximity) MatchWithError(r *http.Request) (bool, error) {
+	ip, err := clientIP(r, m.state)
+	if err != nil {
+		return false, err
+	}
+
+	lat, lon, ok := m.state.coordinates(ip)
+	if !ok {
+		return false, nil
+	}
+
+	return m.Center.distanceKm(lat, lon) <= m.RadiusKm, nil
+}
+
+// MatchCountry matches when the client's country is one of the given ISO country codes.
+// Codes prefixed with ! are excluded instead, so that a list of only exclusions matches every other country,
+// including clients without a known country.
+//
+//	geoip2_country <countries...>
+type MatchCountry struct {
+	state *GeoIp2
+	allow []string
+	deny  []string
+
+	// The ISO country codes to match, like DE, or exclude when prefixed with !, like !DE
+	Countries []string `json:"countries,omitempty"`
+}
+
+func (*MatchCountry) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_country",
+		New: func() caddy.Module { return new(MatchCountry) },
+	}
+}
+
+func (m *MatchCountry) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		var countries = d.RemainingArgs()
+		if len(countries) == 0 {
+			return d.ArgErr()
+		}
+		m.Countries = append(m.Countries, countries...)
+	}
+
+	return nil
+}
+
+func (m *MatchCountry) Provision(ctx caddy.Context) error {
+	m.parseCountries()
+
+	var err error
+	m.state, err = geoip2App(ctx)
+	return err
+}
+
+// parseCountries splits Countries into the codes to match and exclude
+func (m *MatchCountry) parseCountries() {
+	for _, country := range m.Countries {
+		if code, ok := strings.CutPrefix(country, "!"); ok {
+			m.deny = append(m.deny, strings.ToUpper(code))
+		} else {
+			m.allow = append(m.allow, strings.ToUpper(country))
+		}
+	}
+}
+
+func (m *MatchCountry) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+func (m *MatchCountry) MatchWithError(r *http.Request) (bool, error) {
+	ip, err := clientIP(r, m.state)
+	if err != nil {
+		return false, err
+	}
+
+	return m.state.CountryAllowed(ip, m.allow, m.deny), nil
+}
+
+// MatchASNOrg matches when the organization of the client's autonomous system contains one of the given substrings
+// or matches one of the given regular expressions, ignoring case.
+// This catches networks of one organization that span several AS numbers.
+//
+//	geoip2_asn_org <substrings...>
+//
+//	geoip2_asn_org {
+//		contains <substrings...>
+//		regexp   <patterns...>
+//	}
+type MatchASNOrg struct {
+	state    *GeoIp2
+	contains []string
+	patterns []*regexp.Regexp
+
+	// Substrings of the organization name to match
+	Contains []string `json:"contains,omitempty"`
+	// Regular expressions of the organization name to match
+	Regexp []string `json:"regexp,omitempty"`
+}
+
+func (*MatchASNOrg) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_asn_org",
+		New: func() caddy.Module { return new(MatchASNOrg) },
+	}
+}
+
+func (m *MatchASNOrg) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Contains = append(m.Contains, d.RemainingArgs()...)
+
+		for d.NextBlock(0) {
+			var key = d.Val()
+			var args = d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+
+			switch key {
+			case "contains":
+				m.Contains = append(m.Contains, args...)
+			case "regexp":
+				m.Regexp = append(m.Regexp, args...)
+			default:
+				return d.Errf("unknown geoip2_asn_org option %q", key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *MatchASNOrg) Provision(ctx caddy.Context) error {
+	for _, s := range m.Contains {
+		m.contains = append(m.contains, strings.ToLower(s))
+	}
+	for _, pattern := range m.Regexp {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return fmt.Errorf("invalid geoip2_asn_org regexp %q: %v", pattern, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+
+	var err error
+	m.state, err = geoip2App(ctx)
+	return err
+}
+
+func (m *MatchASNOrg) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+func (m *MatchASNOrg) MatchWithError(r *http.Request) (bool, error) {
+	ip, err := clientIP(r, m.state)
+	if err != nil {
+		return false, err
+	}
+
+	rec, err := m.state.LookupASN(ip)
+	if err != nil || rec.AutonomousSystemOrganization == "" {
+		return false, nil
+	}
+
+	var org = strings.ToLower(rec.AutonomousSystemOrganization)
+	for _, s := range m.contains {
+		if strings.Contains(org, s) {
+			return true, nil
+		}
+	}
+	for _, re := range m.patterns {
+		if re.MatchString(rec.AutonomousSystemOrganization) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// MatchASN matches when the client's autonomous system number is one of the given numbers, with an optional AS prefix.
+// Numbers prefixed with ! are excluded instead, so that a list of only exclusions matches every other network,
+// including clients without a known autonomous system.
+//
+//	geoip2_asn <numbers...>
+type MatchASN struct {
+	state *GeoIp2
+	allow []uint
+	deny  []uint
+
+	// The autonomous system numbers to match, like 16509 or AS16509, or exclude when prefixed with !, like !16509
+	ASNs []string `json:"asns,omitempty"`
+}
+
+func (*MatchASN) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.geoip2_asn",
+		New: func() caddy.Module { return new(MatchASN) },
+	}
+}
+
+func (m *MatchASN) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		var asns = d.RemainingArgs()
+		if len(asns) == 0 {
+			return d.ArgErr()
+		}
+		m.ASNs = append(m.ASNs, asns...)
+	}
+
+	return nil
+}
+
+func (m *MatchASN) Provision(ctx caddy.Context) error {
+	if err := m.parseASNs(); err != nil {
+		return err
+	}
+
+	var err error
+	m.state, err = geoip2App(ctx)
+	return err
+}
+
+// parseASNs parses the numbers to match and exclude from ASNs
+func (m *MatchASN) parseASNs() error {
+	for _, asn := range m.ASNs {
+		number, exclude := strings.CutPrefix(asn, "!")
+		if len(number) > 2 && strings.EqualFold(number[:2], "AS") {
+			number = number[2:]
+		}
+
+		n, err := strconv.ParseUint(number, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid geoip2_asn number %q", asn)
+		}
+
+		if exclude {
+			m.deny = append(m.deny, uint(n))
+		} else {
+			m.allow = append(m.allow, uint(n))
+		}
+	}
+
+	return nil
+}
+
+func (m *MatchASN) Match(r *http.Request) bool {
+	match, _ := m.MatchWithError(r)
+	return match
+}
+
+func (m *MatchASN) MatchWithError(r *http.Request) (bool, error) {
+	ip, err := clientIP(r, m.state)
+	if err != nil {
+		return false, err
+	}
+
+	var asn uint
+	if rec, err := m.state.LookupASN(ip); err == nil {
+		asn = rec.AutonomousSystemNumber
+	}
+
+	if asn != 0 && slices.Contains(m.deny, asn) {
+		return false, nil
+	}
+	if len(m.allow) > 0 {
+		return asn != 0 && slices.Contains(m.allow, asn), nil
+	}
+
+	return true, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Module                      = (*MatchLocalTime)(nil)
+	_ caddy.Provisioner                 = (*MatchLocalTime)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchLocalTime)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchLocalTime)(nil)
+
+	_ caddy.Module                      = (*MatchTimeZone)(nil)
+	_ caddy.Provisioner                 = (*MatchTimeZone)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchTimeZone)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchTimeZone)(nil)
+
+	_ caddy.Module                      = (*MatchBoundingBox)(nil)
+	_ caddy.Provisioner                 = (*MatchBoundingBox)(nil)
+	_ caddy.Validator                   = (*MatchBoundingBox)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchBoundingBox)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchBoundingBox)(nil)
+
+	_ caddy.Module                      = (*MatchCountry)(nil)
+	_ caddy.Provisioner                 = (*MatchCountry)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchCountry)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchCountry)(nil)
+
+	_ caddy.Module                      = (*MatchASNOrg)(nil)
+	_ caddy.Provisioner                 = (*MatchASNOrg)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchASNOrg)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchASNOrg)(nil)
+
+	_ caddy.Module                      = (*MatchASN)(nil)
+	_ caddy.Provisioner                 = (*MatchASN)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchASN)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchASN)(nil)
+
+	_ caddy.Module                      = (*MatchProximity)(nil)
+	_ caddy.Provisioner                 = (*MatchProximity)(nil)
+	_ caddy.Validator                   = (*MatchProximity)(nil)
+	_ caddyhttp.RequestMatcherWithError = (*MatchProximity)(nil)
+	_ caddyfile.Unmarshaler             = (*MatchProximity)(nil)
+)
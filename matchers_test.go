@@ -0,0 +1,217 @@
+package geoip2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// matchRequest returns a request from the client ip, as resolved by Caddy
+func matchRequest(ip string) *http.Request {
+	var r = httptest.NewRequest(http.MethodGet, "/", nil)
+	return r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{
+		caddyhttp.ClientIPVarKey: ip,
+	}))
+}
+
+func TestLocalTimeWithin(t *testing.T) {
+	var at = func(hour, minute int) time.Time {
+		return time.Date(2024, time.January, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	for _, c := range []struct {
+		from, to string
+		t        time.Time
+		want     bool
+	}{
+		{"09:00", "17:00", at(9, 0), true},
+		{"09:00", "17:00", at(12, 30), true},
+		{"09:00", "17:00", at(17, 0), false},
+		{"09:00", "17:00", at(8, 59), false},
+		// The window wraps around midnight
+		{"22:00", "06:00", at(22, 0), true},
+		{"22:00", "06:00", at(23, 59), true},
+		{"22:00", "06:00", at(0, 0), true},
+		{"22:00", "06:00", at(5, 59), true},
+		{"22:00", "06:00", at(6, 0), false},
+		{"22:00", "06:00", at(12, 0), false},
+		{"22:00", "06:00", at(21, 59), false},
+		// An empty window never matches
+		{"00:00", "00:00", at(0, 0), false},
+	} {
+		var (
+			m   MatchLocalTime
+			err error
+		)
+		if m.from, err = parseTimeOfDay(c.from); err != nil {
+			t.Fatal(err)
+		}
+		if m.to, err = parseTimeOfDay(c.to); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.within(c.t); got != c.want {
+			t.Errorf("%s-%s within %s = %v, want %v", c.from, c.to, c.t.Format("15:04"), got, c.want)
+		}
+	}
+}
+
+func TestMatchLocalTime(t *testing.T) {
+	var (
+		db    = openDatabase(t, "GeoLite2-City", cityDatabase(t), OpenOptions{})
+		state = &GeoIp2{Locale: "en", databases: []*Database{db}}
+	)
+
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// Windows relative to the current time in London, which wrap around midnight late in the day
+	var (
+		now    = time.Now().In(london)
+		window = func(from, to time.Duration) (time.Duration, time.Duration) {
+			var sinceMidnight = time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+			return (sinceMidnight + from + 24*time.Hour) % (24 * time.Hour), (sinceMidnight + to + 24*time.Hour) % (24 * time.Hour)
+		}
+	)
+
+	for _, c := range []struct {
+		name     string
+		ip       string
+		from, to time.Duration
+		dflt     bool
+		want     bool
+	}{
+		{"within", "81.2.69.1", -time.Hour, time.Hour, false, true},
+		{"outside", "81.2.69.1", time.Hour, 2 * time.Hour, false, false},
+		{"outside with default", "81.2.69.1", time.Hour, 2 * time.Hour, true, false},
+		// Clients without a known time zone match the default
+		{"unknown", "198.51.100.17", -time.Hour, time.Hour, false, false},
+		{"unknown with default", "198.51.100.17", time.Hour, 2 * time.Hour, true, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var m = &MatchLocalTime{state: state, Default: c.dflt}
+			m.from, m.to = window(c.from, c.to)
+
+			got, err := m.MatchWithError(matchRequest(c.ip))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("match = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestMatchCountry(t *testing.T) {
+	var (
+		db    = openDatabase(t, "GeoLite2-City", cityDatabase(t), OpenOptions{})
+		state = &GeoIp2{databases: []*Database{db}}
+	)
+
+	const (
+		london   = "81.2.69.1"
+		berlin   = "5.6.7.8"
+		notFound = "198.51.100.17"
+	)
+
+	for _, c := range []struct {
+		countries []string
+		ip        string
+		want      bool
+	}{
+		{[]string{"GB"}, london, true},
+		{[]string{"GB"}, berlin, false},
+		{[]string{"GB"}, notFound, false},
+		// Codes are matched in any case
+		{[]string{"gb", "DE"}, berlin, true},
+		// Exclusions take precedence over codes to match
+		{[]string{"GB", "DE", "!DE"}, berlin, false},
+		{[]string{"GB", "!DE"}, london, true},
+		// A list of only exclusions matches every other client, including those not in the database
+		{[]string{"!DE"}, london, true},
+		{[]string{"!de"}, berlin, false},
+		{[]string{"!DE"}, notFound, true},
+	} {
+		var m = &MatchCountry{state: state, Countries: c.countries}
+		m.parseCountries()
+
+		got, err := m.MatchWithError(matchRequest(c.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%v matching %s = %v, want %v", c.countries, c.ip, got, c.want)
+		}
+	}
+}
+
+func TestMatchASN(t *testing.T) {
+	var (
+		db = openDatabase(t, "GeoLite2-ASN", writeDatabase(t, "GeoLite2-ASN", map[string]mmdbtype.Map{
+			"81.2.69.0/24": {
+				"autonomous_system_number":       mmdbtype.Uint32(20712),
+				"autonomous_system_organization": mmdbtype.String("Andrews & Arnold Ltd"),
+			},
+			"5.6.7.0/24": {
+				"autonomous_system_number":       mmdbtype.Uint32(3320),
+				"autonomous_system_organization": mmdbtype.String("Deutsche Telekom AG"),
+			},
+		}), OpenOptions{})
+		state = &GeoIp2{databases: []*Database{db}}
+	)
+
+	const (
+		aaisp   = "81.2.69.1"
+		telekom = "5.6.7.8"
+		noASN   = "198.51.100.17"
+	)
+
+	for _, c := range []struct {
+		asns []string
+		ip   string
+		want bool
+	}{
+		{[]string{"20712"}, aaisp, true},
+		{[]string{"20712"}, telekom, false},
+		{[]string{"20712"}, noASN, false},
+		// Numbers may be given with an AS prefix in any case
+		{[]string{"AS20712"}, aaisp, true},
+		{[]string{"as20712", "AS3320"}, telekom, true},
+		// Exclusions take precedence over numbers to match
+		{[]string{"20712", "!20712"}, aaisp, false},
+		{[]string{"20712", "3320", "!AS3320"}, telekom, false},
+		{[]string{"20712", "!3320"}, aaisp, true},
+		// A list of only exclusions matches every other client, including those without an ASN
+		{[]string{"!3320"}, aaisp, true},
+		{[]string{"!3320"}, telekom, false},
+		{[]string{"!3320"}, noASN, true},
+		{[]string{"!AS3320", "!20712"}, noASN, true},
+	} {
+		var m = &MatchASN{state: state, ASNs: c.asns}
+		if err := m.parseASNs(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := m.MatchWithError(matchRequest(c.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%v matching %s = %v, want %v", c.asns, c.ip, got, c.want)
+		}
+	}
+
+	for _, asn := range []string{"AS", "ASN20712", "!", "-1", "4294967296"} {
+		var m = &MatchASN{ASNs: []string{asn}}
+		if err := m.parseASNs(); err == nil {
+			t.Errorf("parsing %q returned no error", asn)
+		}
+	}
+}
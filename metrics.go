@@ -0,0 +1,99 @@
+package geoip2
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Database metrics are shared by every config, as databases are kept across config reloads
+var (
+	lookupsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip2_lookups_total",
+		Help: "Lookups by database edition.",
+	}, []string{"edition"})
+	lookupErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip2_lookup_errors_total",
+		Help: "Lookups that failed by database edition.",
+	}, []string{"edition"})
+	cacheHitsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip2_cache_hits_total",
+		Help: "Lookups answered from the record cache by database edition.",
+	}, []string{"edition"})
+	cacheMissesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip2_cache_misses_total",
+		Help: "Lookups not found in the record cache by database edition.",
+	}, []string{"edition"})
+	updatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip2_updates_total",
+		Help: "Database updates by edition and result, success or failure.",
+	}, []string{"edition", "result"})
+	updateBytesSavedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip2_update_bytes_saved_total",
+		Help: "Bytes not downloaded by updates that found the database up to date, by edition.",
+	}, []string{"edition"})
+)
+
+var databaseAgeDesc = prometheus.NewDesc("geoip2_database_age_seconds", "Seconds since the database was built by edition.", []string{"edition"}, nil)
+
+// databaseAge collects the age of the databases of an app when scraped
+type databaseAge struct {
+	databases []*Database
+}
+
+func (c databaseAge) Describe(ch chan<- *prometheus.Desc) {
+	ch <- databaseAgeDesc
+}
+
+func (c databaseAge) Collect(ch chan<- prometheus.Metric) {
+	for _, db := range c.databases {
+		ch <- prometheus.MustNewConstMetric(databaseAgeDesc, prometheus.GaugeValue, time.Since(db.buildTime()).Seconds(), db.Edition())
+	}
+}
+
+// registerDatabaseMetrics registers the metrics of databases with registry
+func registerDatabaseMetrics(registry *prometheus.Registry, databases []*Database) error {
+	for _, counter := range []*prometheus.CounterVec{lookupsTotal, lookupErrorsTotal, cacheHitsTotal, cacheMissesTotal, updatesTotal, updateBytesSavedTotal} {
+		if _, err := registerCounter(registry, counter); err != nil {
+			return err
+		}
+	}
+
+	return registry.Register(databaseAge{databases: databases})
+}
+
+// registerCounter registers counter with registry, returning the counter already registered
+// by another handler of the same config if there is one
+func registerCounter(registry *prometheus.Registry, counter *prometheus.CounterVec) (*prometheus.CounterVec, error) {
+	err := registry.Register(counter)
+
+	var registered prometheus.AlreadyRegisteredError
+	if errors.As(err, &registered) {
+		return registered.ExistingCollector.(*prometheus.CounterVec), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return counter, nil
+}
+
+// newCountryRequests returns the counter of requests by the country code of the client
+func newCountryRequests() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "geoip2_requests_by_country",
+		Help: "Requests by the ISO country code of the client, unknown if it could not be resolved.",
+	}, []string{"country"})
+}
+
+// countryLabel returns the country label for code, limiting the label to ISO country codes to bound its cardinality
+func countryLabel(code string) string {
+	if code == "" {
+		return "unknown"
+	}
+	if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+		return "other"
+	}
+	return code
+}
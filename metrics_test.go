@@ -0,0 +1,122 @@
+package geoip2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"testing"
+
+	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterValue collects the counter name of edition from registry, which is 0 if it has not been counted yet
+func counterValue(t *testing.T, registry *prometheus.Registry, name, edition string) float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "edition" && label.GetValue() == edition {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestDatabaseMetrics(t *testing.T) {
+	var (
+		city = openDatabase(t, "GeoLite2-City", cityDatabase(t), OpenOptions{CacheSize: 16})
+		asn  = openDatabase(t, "GeoLite2-ASN", writeDatabase(t, "GeoLite2-ASN", map[string]mmdbtype.Map{
+			"81.2.69.0/24": {
+				"autonomous_system_number":       mmdbtype.Uint32(20712),
+				"autonomous_system_organization": mmdbtype.String("Andrews & Arnold Ltd"),
+			},
+		}), OpenOptions{})
+		registry = prometheus.NewRegistry()
+		london   = netip.MustParseAddr("81.2.69.1")
+	)
+	if err := registerDatabaseMetrics(registry, []*Database{city, asn}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters are shared by every database of an edition, so other tests may have counted lookups already
+	type counts struct{ lookups, hits, misses float64 }
+	var collect = func(edition string) counts {
+		return counts{
+			lookups: counterValue(t, registry, "geoip2_lookups_total", edition),
+			hits:    counterValue(t, registry, "geoip2_cache_hits_total", edition),
+			misses:  counterValue(t, registry, "geoip2_cache_misses_total", edition),
+		}
+	}
+	var before = map[string]counts{"GeoLite2-City": collect("GeoLite2-City"), "GeoLite2-ASN": collect("GeoLite2-ASN")}
+
+	// The second City lookup of the same client is answered from the cache
+	for range 2 {
+		if _, err := city.City(london); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := asn.ASN(london); err != nil {
+		t.Fatal(err)
+	}
+	// Lookups the database does not support are not counted
+	if _, err := asn.City(london); err == nil {
+		t.Fatal("City lookup in an ASN database returned no error")
+	}
+
+	for edition, want := range map[string]counts{
+		"GeoLite2-City": {lookups: 2, hits: 1, misses: 1},
+		"GeoLite2-ASN":  {lookups: 1},
+	} {
+		var got = collect(edition)
+		got.lookups -= before[edition].lookups
+		got.hits -= before[edition].hits
+		got.misses -= before[edition].misses
+		if got != want {
+			t.Errorf("%s: counted %+v, want %+v", edition, got, want)
+		}
+	}
+}
+
+func TestUpdateBytesSaved(t *testing.T) {
+	// The update server always finds the database up to date
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+
+	var (
+		filePath = cityDatabase(t)
+		db       = openDatabase(t, "GeoLite2-City", filePath, OpenOptions{})
+		config   = &geoipupdate.Config{AccountID: 1, LicenseKey: "test", URL: srv.URL}
+		registry = prometheus.NewRegistry()
+	)
+	if err := registerDatabaseMetrics(registry, []*Database{db}); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var before = counterValue(t, registry, "geoip2_update_bytes_saved_total", "GeoLite2-City")
+	if err := db.selfUpdater(config, srv.Client(), "GeoLite2-City", filePath)(); err != nil {
+		t.Fatal(err)
+	}
+	if saved := counterValue(t, registry, "geoip2_update_bytes_saved_total", "GeoLite2-City") - before; saved != float64(fi.Size()) {
+		t.Errorf("counted %v bytes saved, want the database size %d", saved, fi.Size())
+	}
+}
@@ -1,34 +1,117 @@
 package geoip2
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/maxmind/geoipupdate/v4/pkg/geoipupdate"
+	"github.com/oschwald/geoip2-golang/v2"
+	"go.uber.org/zap"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 )
 
 const ModuleName = "geoip2"
 
+// ErrNoDatabase is returned by lookups when none of the loaded databases support them
+var ErrNoDatabase = errors.New("no database supports this lookup")
+
 type GeoIp2 struct {
-	databases []*Database
+	databases  []*Database
+	webService *webService
+	poolKey    string
+	started    bool
 
 	// Your MaxMind account ID. This was formerly known as UserId.
 	AccountID string `json:"account_id,omitempty"`
-	// The directory to store the database files. Defaults to DATADIR
+	// The directory to store the database files. Defaults to geoip2 in Caddy's data directory
 	DatabaseDirectory string `json:"database_directory,omitempty"`
 	// Your case-sensitive MaxMind license key.
 	LicenseKey string `json:"license_key,omitempty"`
+	// A file holding the account ID, such as a Docker or Kubernetes secret. Read when provisioned, surrounding whitespace is ignored
+	AccountIDFile string `json:"account_id_file,omitempty"`
+	// A file holding the license key, such as a Docker or Kubernetes secret. Read when provisioned, surrounding whitespace is ignored
+	LicenseKeyFile string `json:"license_key_file,omitempty"`
+	// A key in Caddy's storage holding the account ID and license key as JSON, like {"account_id": "...", "license_key": "..."}.
+	// Used for settings not given in the config, so that a cluster can share its credentials
+	CredentialsStorageKey string `json:"credentials_storage_key,omitempty"`
 	// Enter the edition IDs of the databases you would like to update.
-	// Should be GeoLite2-Ciy, GeoLite2-ASN
+	// Such as GeoLite2-City and GeoLite2-ASN, or paid editions like GeoIP2-City. Defaults to GeoLite2-City and GeoLite2-ASN
 	EditionID []string `json:"edition_id,omitempty"`
 	//update url to use. Defaults to https://updates.maxmind.com
 	UpdateUrl string `json:"update_url,omitempty"`
 	// The Frequency in seconds to run update. Default to 0, only update On Start
 	UpdateFrequency int `json:"update_frequency,omitempty"`
+	// The number of times a failed automatic update is retried before waiting for the next one. Defaults to 0
+	UpdateRetries int `json:"update_retries,omitempty"`
+	// The delay in seconds before retrying a failed update, doubled for each retry. Defaults to 60
+	UpdateRetryInterval int `json:"update_retry_interval,omitempty"`
+	// The name of the database files in database_directory, where {edition} is replaced by the edition ID.
+	// Can be a glob such as {edition}_*.mmdb, in which case the most recently modified match is used. Defaults to {edition}.mmdb
+	FilePattern string `json:"file_pattern,omitempty"`
+	// The maximum age in seconds of a database build before a warning is logged. Defaults to 0, never stale
+	MaxAge int `json:"max_age,omitempty"`
+	// Per-edition settings keyed by edition ID, overriding the global settings
+	Editions map[string]*EditionConfig `json:"editions,omitempty"`
+	// The local IP address to download updates from, for hosts with several interfaces. Defaults to any
+	SourceAddress string `json:"source_address,omitempty"`
+	// Paths of database files to open as they are, such as DB-IP or custom databases, which are never updated.
+	// They are consulted after the editions in edition_id and named after their file name without extension
+	DatabaseFiles []string `json:"database_files,omitempty"`
+	// Skip verifying databases after they are downloaded. Only recommended for large databases from a trusted source
+	SkipVerify bool `json:"skip_verify,omitempty"`
+	// Read databases into memory instead of memory mapping them. Defaults to memory mapping
+	LoadIntoMemory bool `json:"load_into_memory,omitempty"`
+	// Reopen databases that are not updated automatically, such as database_files, when their file is replaced,
+	// for example by a separate downloader. Disabled by default
+	WatchFile bool `json:"watch_file,omitempty"`
+	// Store each downloaded database under a name with its content hash, with the usual file name as a symlink to the current one,
+	// and keep this many of the latest versions for rollback. Defaults to 0, databases are replaced in place
+	KeepVersions int `json:"keep_versions,omitempty"`
+	// Look up requests sent as TLS early data instead of rejecting them with 425 Too Early,
+	// for when TLS is terminated by a layer that does not report a completed handshake.
+	// This weakens the protection against spoofed client IPs in 0-RTT data. Disabled by default
+	DisableEarlyDataCheck bool `json:"disable_early_data_check,omitempty"`
+	// Fail to start when a database's type does not match its edition_id, instead of logging a warning
+	StrictDatabaseType bool `json:"strict_database_type,omitempty"`
+	// The language of the name placeholders, one of de, en, es, fr, ja, pt-BR, ru or zh-CN.
+	// Names missing in the locale fall back to English. Defaults to en
+	Locale string `json:"locale,omitempty"`
+	// The number of decoded City, Country and ASN records each to cache per database. Defaults to 0, no cache
+	CacheSize int `json:"cache_size,omitempty"`
+	// Query the MaxMind GeoIP2 web service when no local database can resolve an IP. Disabled by default
+	WebServiceFallback *WebServiceConfig `json:"web_service_fallback,omitempty"`
+}
+
+// EditionConfig holds the settings that can be overridden for a single edition
+type EditionConfig struct {
+	// The maximum age in seconds of this edition's database build. Defaults to the global max_age
+	MaxAge int `json:"max_age,omitempty"`
+	// How often in seconds to update this edition. Defaults to the global update_frequency
+	Frequency int `json:"frequency,omitempty"`
+	// Databases with a higher priority are consulted first. Defaults to 0, ties keep the edition_id order
+	Priority int `json:"priority,omitempty"`
+	// Whether to download and update this edition. When false the database file is managed outside Caddy
+	// and used as is, even if credentials are configured. Defaults to true
+	AutoUpdate *bool `json:"auto_update,omitempty"`
+}
+
+// edition returns the per-edition settings for the given edition, if any
+func (g *GeoIp2) edition(edition string) EditionConfig {
+	if c, ok := g.Editions[edition]; ok && c != nil {
+		return *c
+	}
+	return EditionConfig{}
 }
 
 func init() {
@@ -53,9 +136,37 @@ func parseGeoip2(d *caddyfile.Dispenser, _ any) (any, error) {
 }
 
 func (g *GeoIp2) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
-	for d.Next() {
+	d.Next() // consume option name
+	for d.NextBlock(0) {
 		var value string
 		key := d.Val()
+
+		// Options that only take a block
+		switch key {
+		case "web_service_fallback":
+			g.WebServiceFallback = new(WebServiceConfig)
+			err := g.WebServiceFallback.UnmarshalCaddyfile(d)
+			if err != nil {
+				return err
+			}
+			continue
+		case "skip_verify":
+			g.SkipVerify = true
+			continue
+		case "load_into_memory":
+			g.LoadIntoMemory = true
+			continue
+		case "watch_file":
+			g.WatchFile = true
+			continue
+		case "disable_early_data_check":
+			g.DisableEarlyDataCheck = true
+			continue
+		case "strict_database_type":
+			g.StrictDatabaseType = true
+			continue
+		}
+
 		if !d.Args(&value) {
 			continue
 		}
@@ -69,18 +180,78 @@ func (g *GeoIp2) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		case "license_key":
 			g.LicenseKey = value
 			break
+		case "account_id_file":
+			g.AccountIDFile = value
+			break
+		case "license_key_file":
+			g.LicenseKeyFile = value
+			break
+		case "credentials_storage_key":
+			g.CredentialsStorageKey = value
+			break
 		case "edition_id":
-			g.EditionID = append(g.EditionID, value)
+			var editions = append([]string{value}, d.RemainingArgs()...)
+			g.EditionID = append(g.EditionID, editions...)
+			err := g.unmarshalEdition(d, editions...)
+			if err != nil {
+				return err
+			}
 			break
 		case "update_url":
 			g.UpdateUrl = value
 			break
+		case "source_address":
+			g.SourceAddress = value
+			break
+		case "locale":
+			g.Locale = value
+			break
+		case "file_pattern":
+			g.FilePattern = value
+			break
+		case "database_file":
+			g.DatabaseFiles = append(g.DatabaseFiles, value)
+			break
 		case "update_frequency":
 			UpdateFrequency, err := strconv.Atoi(value)
 			if err == nil {
 				g.UpdateFrequency = UpdateFrequency
 			}
 			break
+		case "update_retries":
+			UpdateRetries, err := strconv.Atoi(value)
+			if err == nil {
+				g.UpdateRetries = UpdateRetries
+			}
+			break
+		case "update_retry_interval":
+			UpdateRetryInterval, err := strconv.Atoi(value)
+			if err != nil || UpdateRetryInterval <= 0 {
+				return d.Errf("update_retry_interval must be a positive number of seconds, got %q", value)
+			}
+			g.UpdateRetryInterval = UpdateRetryInterval
+			break
+		case "max_age":
+			MaxAge, err := strconv.Atoi(value)
+			if err == nil {
+				g.MaxAge = MaxAge
+			}
+			break
+		case "cache_size":
+			CacheSize, err := strconv.Atoi(value)
+			if err == nil {
+				g.CacheSize = CacheSize
+			}
+			break
+		case "keep_versions":
+			KeepVersions, err := strconv.Atoi(value)
+			if err == nil {
+				g.KeepVersions = KeepVersions
+			}
+			break
+		}
+		if d.NextArg() {
+			return d.ArgErr()
 		}
 	}
 	caddy.Log().Named("geoip2").Info(fmt.Sprintf("setup Config %v", g))
@@ -88,7 +259,66 @@ func (g *GeoIp2) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// unmarshalEdition parses the optional settings block following an edition_id, which applies to each of its editions
+func (g *GeoIp2) unmarshalEdition(d *caddyfile.Dispenser, editions ...string) error {
+	var config EditionConfig
+	var hasBlock bool
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		hasBlock = true
+
+		var value string
+		key := d.Val()
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		switch key {
+		case "max_age":
+			MaxAge, err := strconv.Atoi(value)
+			if err == nil {
+				config.MaxAge = MaxAge
+			}
+			break
+		case "frequency":
+			Frequency, err := strconv.Atoi(value)
+			if err == nil {
+				config.Frequency = Frequency
+			}
+			break
+		case "priority":
+			Priority, err := strconv.Atoi(value)
+			if err == nil {
+				config.Priority = Priority
+			}
+			break
+		case "auto_update":
+			AutoUpdate, err := strconv.ParseBool(value)
+			if err == nil {
+				config.AutoUpdate = &AutoUpdate
+			}
+			break
+		default:
+			return d.Errf("unknown edition option %q", key)
+		}
+	}
+
+	if hasBlock {
+		if g.Editions == nil {
+			g.Editions = make(map[string]*EditionConfig)
+		}
+		for _, edition := range editions {
+			var config = config
+			g.Editions[edition] = &config
+		}
+	}
+
+	return nil
+}
+
 func (g *GeoIp2) Start() error {
+	// Files of the previous config are only cleaned up once this config has started, see Cleanup
+	useDatabases(g.databases)
+	g.started = true
 	return nil
 }
 
@@ -96,7 +326,7 @@ func (g *GeoIp2) Stop() error {
 	return nil
 }
 
-func (g *GeoIp2) Provision(_ caddy.Context) error {
+func (g *GeoIp2) Provision(ctx caddy.Context) error {
 	caddy.Log().Named("geoip2").Info(fmt.Sprintf("Provision"))
 
 	var repl = caddy.NewReplacer()
@@ -107,13 +337,42 @@ func (g *GeoIp2) Provision(_ caddy.Context) error {
 	if g.UpdateFrequency == 0 {
 		g.UpdateFrequency = 604800 // 7 days
 	}
+	if g.UpdateRetryInterval == 0 {
+		g.UpdateRetryInterval = 60
+	}
 	if g.DatabaseDirectory == "" {
-		g.DatabaseDirectory = "/tmp/"
+		// Caddy's data directory is chosen per OS and persists across restarts, unlike /tmp
+		g.DatabaseDirectory = filepath.Join(caddy.AppDataDir(), "geoip2")
+		if err := os.MkdirAll(g.DatabaseDirectory, 0o700); err != nil {
+			return fmt.Errorf("failed to create database directory: %w", err)
+		}
+	}
+	if g.Locale == "" {
+		g.Locale = "en"
+	}
+	if err := validLocale(g.Locale); err != nil {
+		return err
 	}
-	if len(g.EditionID) == 0 {
+	caddy.Log().Named("geoip2").Info("using database directory", zap.String("path", g.DatabaseDirectory))
+	if len(g.EditionID) == 0 && len(g.DatabaseFiles) == 0 {
 		g.EditionID = []string{"GeoLite2-City", "GeoLite2-ASN"}
 	}
 
+	if err := g.readCredentialFiles(); err != nil {
+		return err
+	}
+
+	if g.CredentialsStorageKey != "" {
+		err := g.loadCredentials(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := g.validate(); err != nil {
+		return err
+	}
+
 	// Initialize updater config if both account ID and license key is set
 	var config *geoipupdate.Config
 	if g.AccountID != "" && g.LicenseKey != "" {
@@ -130,30 +389,376 @@ func (g *GeoIp2) Provision(_ caddy.Context) error {
 		}
 	}
 
-	for _, edition := range g.EditionID {
-		db, err := NewDatabase(config, edition, g.DatabaseDirectory, time.Second*time.Duration(g.UpdateFrequency))
+	var client *http.Client
+	if g.SourceAddress != "" && config != nil {
+		sourceAddress, err := netip.ParseAddr(g.SourceAddress)
+		if err != nil {
+			return fmt.Errorf("failed to parse source address: %w", err)
+		}
+
+		client = newUpdateClient(config, sourceAddress)
+	}
+
+	if g.WebServiceFallback != nil {
+		if g.AccountID == "" || g.LicenseKey == "" {
+			return fmt.Errorf("web_service_fallback requires account_id and license_key")
+		}
+
+		g.webService = newWebService(g.WebServiceFallback, repl.ReplaceKnown(g.AccountID, ""), repl.ReplaceKnown(g.LicenseKey, ""))
+	}
+
+	// Databases are kept across reloads that don't change the app config
+	key, err := poolKey(g)
+	if err != nil {
+		return err
+	}
+
+	dbs, loaded, err := databasePool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		return g.openDatabases(config, client)
+	})
+	if err != nil {
+		return err
+	}
+	if loaded {
+		caddy.Log().Named("geoip2").Info("config unchanged, reusing databases")
+	}
+
+	g.poolKey = key
+	g.databases = dbs.(databaseSet)
+
+	if err := registerDatabaseMetrics(ctx.GetMetricsRegistry(), g.databases); err != nil {
+		return fmt.Errorf("registering metrics: %w", err)
+	}
+
+	return nil
+}
+
+// openDatabases opens the databases of every configured edition
+func (g *GeoIp2) openDatabases(config *geoipupdate.Config, client *http.Client) (databaseSet, error) {
+	// Databases are consulted in edition_id order unless a priority overrides it
+	var editions = slices.Clone(g.EditionID)
+	slices.SortStableFunc(editions, func(a, b string) int {
+		return g.edition(b).Priority - g.edition(a).Priority
+	})
+
+	var databases databaseSet
+	for _, edition := range editions {
+		var maxAge = g.MaxAge
+		if c := g.edition(edition); c.MaxAge > 0 {
+			maxAge = c.MaxAge
+		}
+		var frequency = g.UpdateFrequency
+		if c := g.edition(edition); c.Frequency > 0 {
+			frequency = c.Frequency
+		}
+
+		filePath, err := databasePath(g.DatabaseDirectory, g.FilePattern, edition)
+		if err != nil {
+			_ = databases.Destruct()
+			return nil, err
+		}
+
+		// Pinned editions are opened without an update config so that they are never downloaded
+		var editionConfig = config
+		if c := g.edition(edition); c.AutoUpdate != nil && !*c.AutoUpdate {
+			editionConfig = nil
+		}
+
+		db, err := NewDatabase(editionConfig, client, edition, filePath, time.Second*time.Duration(frequency), time.Second*time.Duration(maxAge), g.KeepVersions, RetryOptions{
+			Retries:  g.UpdateRetries,
+			Interval: time.Second * time.Duration(g.UpdateRetryInterval),
+		}, OpenOptions{
+			SkipVerify:     g.SkipVerify,
+			LoadIntoMemory: g.LoadIntoMemory,
+			CacheSize:      g.CacheSize,
+			Watch:          g.WatchFile,
+		})
+		if err != nil {
+			_ = databases.Destruct()
+			return nil, fmt.Errorf("failed to initialize database for GeoIP edition %s: %w", edition, err)
+		}
+
+		databases = append(databases, db)
+
+		if t := db.DatabaseType(); !typeMatchesEdition(t, edition) {
+			if g.StrictDatabaseType {
+				_ = databases.Destruct()
+				return nil, fmt.Errorf("database %s of edition %s is of type %s", filePath, edition, t)
+			}
+			caddy.Log().Named(ModuleName).Warn("database type does not match its edition, lookups may return no data",
+				zap.String("edition", edition), zap.String("path", filePath), zap.String("database_type", t))
+		}
+	}
+
+	for _, filePath := range g.DatabaseFiles {
+		var name = databaseFileName(filePath)
+
+		if _, err := os.Stat(filePath); err != nil {
+			_ = databases.Destruct()
+			return nil, fmt.Errorf("database_file %s: %w", filePath, err)
+		}
+
+		db, err := NewDatabase(nil, nil, name, filePath, 0, time.Second*time.Duration(g.MaxAge), 0, RetryOptions{}, OpenOptions{
+			SkipVerify:     g.SkipVerify,
+			LoadIntoMemory: g.LoadIntoMemory,
+			CacheSize:      g.CacheSize,
+			Watch:          g.WatchFile,
+		})
 		if err != nil {
-			return fmt.Errorf("failed to initialize database for GeoIP edition %s: %w", edition, err)
+			_ = databases.Destruct()
+			return nil, fmt.Errorf("failed to open database file %s: %w", filePath, err)
+		}
+
+		databases = append(databases, db)
+	}
+
+	return databases, nil
+}
+
+// databaseFileName returns the name a database file is known by, which is its base name without extension
+func databaseFileName(filePath string) string {
+	return strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+}
+
+// editionKind returns the kind of data of a MaxMind edition or database type, like City for GeoLite2-City
+func editionKind(s string) string {
+	for _, prefix := range []string{"GeoLite2-", "GeoIP2-", "GeoIP-"} {
+		if kind, ok := strings.CutPrefix(s, prefix); ok {
+			return strings.ToLower(kind)
 		}
+	}
+	return strings.ToLower(s)
+}
+
+// typeMatchesEdition reports whether a database of type databaseType is consistent with edition.
+// Regional variants like GeoIP2-City-Europe are consistent with the edition they are a subset of.
+func typeMatchesEdition(databaseType, edition string) bool {
+	var t, e = editionKind(databaseType), editionKind(edition)
+	return strings.HasPrefix(t, e) || strings.HasPrefix(e, t)
+}
 
-		g.databases = append(g.databases, db)
+// readCredentialFiles reads the account ID and license key from account_id_file and license_key_file
+func (g *GeoIp2) readCredentialFiles() error {
+	for _, f := range []struct {
+		option string
+		path   string
+		value  *string
+	}{
+		{"account_id", g.AccountIDFile, &g.AccountID},
+		{"license_key", g.LicenseKeyFile, &g.LicenseKey},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if *f.value != "" {
+			return fmt.Errorf("%s and %s_file cannot both be set", f.option, f.option)
+		}
+
+		b, err := os.ReadFile(f.path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_file: %w", f.option, err)
+		}
+		*f.value = strings.TrimSpace(string(b))
+		if *f.value == "" {
+			return fmt.Errorf("%s_file %s is empty", f.option, f.path)
+		}
 	}
 
 	return nil
 }
 
-func (g *GeoIp2) Destruct() error {
-	for _, db := range g.databases {
-		_ = db.Close()
+// loadCredentials fills in the account ID and license key that are not configured from Caddy's storage
+func (g *GeoIp2) loadCredentials(ctx caddy.Context) error {
+	b, err := ctx.Storage().Load(ctx, g.CredentialsStorageKey)
+	if err != nil {
+		return fmt.Errorf("failed to load credentials from storage: %w", err)
+	}
+
+	var credentials struct {
+		AccountID  json.Number `json:"account_id"`
+		LicenseKey string      `json:"license_key"`
+	}
+	err = json.Unmarshal(b, &credentials)
+	if err != nil {
+		return fmt.Errorf("failed to parse credentials from storage: %w", err)
+	}
+
+	if g.AccountID == "" {
+		g.AccountID = credentials.AccountID.String()
+	}
+	if g.LicenseKey == "" {
+		g.LicenseKey = credentials.LicenseKey
 	}
 
 	return nil
 }
 
+// lookupFirst looks up ip in the first database that supports the lookup and has a record for it.
+// If none have data for ip the first empty record is returned, and ErrNoDatabase if no database supports the lookup.
+func lookupFirst[T interface{ HasData() bool }](databases []*Database, ip netip.Addr, lookup func(*Database, netip.Addr) (T, error)) (T, error) {
+	var (
+		err      error = ErrNoDatabase
+		fallback T
+		found    bool
+	)
+	for _, db := range databases {
+		rec, lookupErr := lookup(db, ip)
+		if lookupErr == nil {
+			// A database without data for ip falls through to the next one
+			if rec.HasData() {
+				return rec, nil
+			}
+			if !found {
+				fallback, found = rec, true
+			}
+			continue
+		}
+
+		var invalidMethod geoip2.InvalidMethodError
+		if !errors.As(lookupErr, &invalidMethod) {
+			err = lookupErr
+		}
+	}
+
+	if found {
+		return fallback, nil
+	}
+
+	var zero T
+	return zero, err
+}
+
+// LookupCity returns the City record for ip from the first database that supports City lookups,
+// or ErrNoDatabase if none do. The record may be shared and must not be modified.
+func (g *GeoIp2) LookupCity(ip netip.Addr) (*geoip2.City, error) {
+	return lookupFirst(g.databases, ip, (*Database).City)
+}
+
+// LookupCountry returns the Country record for ip from the first database that supports Country lookups,
+// or ErrNoDatabase if none do. The record may be shared and must not be modified.
+func (g *GeoIp2) LookupCountry(ip netip.Addr) (*geoip2.Country, error) {
+	return lookupFirst(g.databases, ip, (*Database).Country)
+}
+
+// LookupASN returns the ASN record for ip from the first database that supports ASN lookups,
+// or ErrNoDatabase if none do. The record may be shared and must not be modified.
+func (g *GeoIp2) LookupASN(ip netip.Addr) (*geoip2.ASN, error) {
+	return lookupFirst(g.databases, ip, (*Database).ASN)
+}
+
+// coordinates returns the approximate latitude and longitude of ip, reporting false if they are unknown
+func (g *GeoIp2) coordinates(ip netip.Addr) (float64, float64, bool) {
+	rec, err := g.LookupCity(ip)
+	if err != nil || rec.Location.Latitude == nil || rec.Location.Longitude == nil {
+		return 0, 0, false
+	}
+
+	return *rec.Location.Latitude, *rec.Location.Longitude, true
+}
+
+// CountryAllowed reports whether the country of ip passes the allow and deny lists of ISO country codes.
+// A country in deny is never allowed. If allow is not empty, the country must be in it,
+// so IPs without a known country are only allowed when allow is empty.
+// Networks without a country are checked by the country they are registered in.
+func (g *GeoIp2) CountryAllowed(ip netip.Addr, allow, deny []string) bool {
+	var code string
+	if rec, err := g.LookupCountry(ip); err == nil {
+		code = rec.Country.ISOCode
+		if code == "" {
+			code = rec.RegisteredCountry.ISOCode
+		}
+	}
+
+	if code != "" && slices.Contains(deny, code) {
+		return false
+	}
+	if len(allow) > 0 {
+		return code != "" && slices.Contains(allow, code)
+	}
+
+	return true
+}
+
+// knownEditions are the MaxMind editions available as MMDB databases.
+// Regional variants of an edition, like GeoIP2-City-Europe, are named after it with a suffix.
+var knownEditions = []string{
+	"GeoLite2-ASN", "GeoLite2-City", "GeoLite2-Country",
+	"GeoIP2-Anonymous-IP", "GeoIP2-City", "GeoIP2-Connection-Type", "GeoIP2-Country",
+	"GeoIP2-Domain", "GeoIP2-Enterprise", "GeoIP2-ISP", "GeoIP-Anonymous-Plus",
+}
+
+// knownEdition reports whether edition is one of knownEditions or a regional variant of one
+func knownEdition(edition string) bool {
+	return slices.ContainsFunc(knownEditions, func(known string) bool {
+		return edition == known || strings.HasPrefix(edition, known+"-")
+	})
+}
+
+// validate checks the config before any database is downloaded or opened.
+// It runs during provisioning rather than in Validate, which Caddy only calls once provisioning has finished.
+func (g *GeoIp2) validate() error {
+	// Credentials from credential files and credentials_storage_key are loaded before this, so they are included here
+	if (g.AccountID == "") != (g.LicenseKey == "") {
+		return fmt.Errorf("account_id and license_key must be set together")
+	}
+
+	// A zero interval was replaced by the default, and retries wait a random fraction of the interval
+	if g.UpdateRetryInterval < 0 {
+		return fmt.Errorf("update_retry_interval must be positive, got %d", g.UpdateRetryInterval)
+	}
+
+	for _, edition := range g.EditionID {
+		if !knownEdition(edition) {
+			caddy.Log().Named(ModuleName).Warn("unknown edition, check edition_id for typos", zap.String("edition", edition))
+		}
+	}
+
+	// Lookup results and edition placeholders are keyed by edition or database file name
+	var names = make(map[string]bool, len(g.EditionID)+len(g.DatabaseFiles))
+	for _, edition := range g.EditionID {
+		if names[edition] {
+			return fmt.Errorf("duplicate edition %s", edition)
+		}
+		names[edition] = true
+	}
+	for _, filePath := range g.DatabaseFiles {
+		var name = databaseFileName(filePath)
+		if names[name] {
+			return fmt.Errorf("database_file %s: duplicate database name %s", filePath, name)
+		}
+		names[name] = true
+	}
+
+	// Databases are downloaded into the database directory
+	if g.AccountID != "" {
+		f, err := os.CreateTemp(g.DatabaseDirectory, ".geoip2-validate-*")
+		if err != nil {
+			return fmt.Errorf("database directory %s is not writable: %w", g.DatabaseDirectory, err)
+		}
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+
+	return nil
+}
+
+// Cleanup releases the databases of this config once it is replaced by a reload or fails to load
+func (g *GeoIp2) Cleanup() error {
+	// The databases are closed once no config uses them anymore
+	_, err := databasePool.Delete(g.poolKey)
+
+	// When replaced by a reload, remove the downloaded files the new config does not use
+	if g.started {
+		removeUnusedDatabases(caddy.Log().Named(ModuleName), g.databases)
+	}
+
+	return err
+}
+
 var (
 	_ caddyfile.Unmarshaler = (*GeoIp2)(nil)
 	_ caddy.Module          = (*GeoIp2)(nil)
 	_ caddy.Provisioner     = (*GeoIp2)(nil)
-	_ caddy.Destructor      = (*GeoIp2)(nil)
+	_ caddy.CleanerUpper    = (*GeoIp2)(nil)
 	_ caddy.App             = (*GeoIp2)(nil)
 )
@@ -0,0 +1,155 @@
+package geoip2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// startApp provisions and starts the app g, as Caddy does when loading a config
+func startApp(t *testing.T, g *GeoIp2) {
+	t.Helper()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	if err := g.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Start(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stopApp stops and cleans up the app g, as Caddy does when it is replaced by a reload
+func stopApp(t *testing.T, g *GeoIp2) {
+	t.Helper()
+
+	if err := g.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadClosesDatabases(t *testing.T) {
+	var (
+		cityPath    = cityDatabase(t)
+		countryPath = writeDatabase(t, "GeoLite2-Country", map[string]mmdbtype.Map{
+			"81.2.69.0/24": {"country": mmdbtype.Map{"iso_code": mmdbtype.String("GB")}},
+		})
+		london = netip.MustParseAddr("81.2.69.1")
+		open   = func(db *Database) bool {
+			_, err := db.Country(london)
+			return err == nil
+		}
+	)
+
+	var old = &GeoIp2{DatabaseDirectory: t.TempDir(), DatabaseFiles: []string{cityPath}}
+	startApp(t, old)
+	var oldDatabase = old.databases[0]
+
+	// A reload with the same app config reuses the open databases
+	var same = &GeoIp2{DatabaseDirectory: old.DatabaseDirectory, DatabaseFiles: []string{cityPath}}
+	startApp(t, same)
+	stopApp(t, old)
+	if same.databases[0] != oldDatabase {
+		t.Error("reload with the same config opened the databases again")
+	}
+	if !open(oldDatabase) {
+		t.Fatal("database closed while the new config still uses it")
+	}
+
+	// A reload with a different app config closes the databases of the replaced one
+	var changed = &GeoIp2{DatabaseDirectory: old.DatabaseDirectory, DatabaseFiles: []string{countryPath}}
+	startApp(t, changed)
+	stopApp(t, same)
+	if open(oldDatabase) {
+		t.Error("database of the replaced config is still open")
+	}
+	if !open(changed.databases[0]) {
+		t.Error("database of the new config is closed")
+	}
+
+	stopApp(t, changed)
+	if open(changed.databases[0]) {
+		t.Error("database is still open after the last config stopped")
+	}
+}
+
+func TestProvisionValidatesBeforeDownloading(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	// A file in place of the database directory cannot be written to, even as root
+	var notDirectory = filepath.Join(t.TempDir(), "geoip2")
+	if err := os.WriteFile(notDirectory, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		g    *GeoIp2
+		want string
+	}{
+		{"credentials set apart", &GeoIp2{AccountID: "1", EditionID: []string{"GeoLite2-City"}}, "must be set together"},
+		{"duplicate edition", &GeoIp2{AccountID: "1", LicenseKey: "test", EditionID: []string{"GeoLite2-City", "GeoLite2-City"}}, "duplicate edition"},
+		{"duplicate database name", &GeoIp2{DatabaseFiles: []string{"/a/city.mmdb", "/b/city.mmdb"}}, "duplicate database name"},
+		{"negative retry interval", &GeoIp2{UpdateRetryInterval: -1}, "update_retry_interval must be positive"},
+		{"directory not writable", &GeoIp2{AccountID: "1", LicenseKey: "test", DatabaseDirectory: notDirectory, EditionID: []string{"GeoLite2-City"}}, "not writable"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.g.UpdateUrl = srv.URL
+			if c.g.DatabaseDirectory == "" {
+				c.g.DatabaseDirectory = t.TempDir()
+			}
+
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+
+			err := c.g.Provision(ctx)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("Provision() = %v, want an error containing %q", err, c.want)
+			}
+			if n := requests.Load(); n != 0 {
+				t.Errorf("made %d update requests before the config was found invalid", n)
+			}
+		})
+	}
+}
+
+func TestUnmarshalRetryInterval(t *testing.T) {
+	for _, c := range []struct {
+		value string
+		want  int
+	}{
+		{"30", 30},
+		{"0", 0},
+		{"-30", 0},
+		{"soon", 0},
+	} {
+		var g GeoIp2
+		err := g.UnmarshalCaddyfile(caddyfile.NewTestDispenser("geoip2 {\n update_retry_interval " + c.value + "\n}"))
+		if (err == nil) != (c.want > 0) {
+			t.Errorf("update_retry_interval %s: error = %v", c.value, err)
+		}
+		if g.UpdateRetryInterval != c.want {
+			t.Errorf("update_retry_interval %s: UpdateRetryInterval = %d, want %d", c.value, g.UpdateRetryInterval, c.want)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package geoip2
+
+import (
+	"fmt"
+
+	"github.com/oschwald/geoip2-golang/v2"
+)
+
+// locales are the languages names are available in, by their locale code in GeoIP2 databases
+var locales = map[string]func(geoip2.Names) string{
+	"de":    func(n geoip2.Names) string { return n.German },
+	"en":    func(n geoip2.Names) string { return n.English },
+	"es":    func(n geoip2.Names) string { return n.Spanish },
+	"fr":    func(n geoip2.Names) string { return n.French },
+	"ja":    func(n geoip2.Names) string { return n.Japanese },
+	"pt-BR": func(n geoip2.Names) string { return n.BrazilianPortuguese },
+	"ru":    func(n geoip2.Names) string { return n.Russian },
+	"zh-CN": func(n geoip2.Names) string { return n.SimplifiedChinese },
+}
+
+// validLocale returns an error if names are not available in locale
+func validLocale(locale string) error {
+	if _, ok := locales[locale]; !ok {
+		return fmt.Errorf("unsupported locale %q, must be one of de, en, es, fr, ja, pt-BR, ru or zh-CN", locale)
+	}
+	return nil
+}
+
+// localName returns the name in locale, falling back to English if there is none
+func localName(n geoip2.Names, locale string) string {
+	if name, ok := locales[locale]; ok {
+		if s := name(n); s != "" {
+			return s
+		}
+	}
+	return n.English
+}
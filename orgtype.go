@@ -0,0 +1,78 @@
+package geoip2
+
+import (
+	"strings"
+)
+
+const (
+	orgTypeHosting     = "hosting"
+	orgTypeResidential = "residential"
+	orgTypeMobile      = "mobile"
+	orgTypeBusiness    = "business"
+	orgTypeEducation   = "education"
+)
+
+// userTypeOrgTypes maps the MaxMind Enterprise user_type trait to an organization type
+var userTypeOrgTypes = map[string]string{
+	"hosting":                  orgTypeHosting,
+	"content_delivery_network": orgTypeHosting,
+	"search_engine_spider":     orgTypeHosting,
+	"consumer_privacy_network": orgTypeHosting,
+	"cellular":                 orgTypeMobile,
+	"residential":              orgTypeResidential,
+	"dialup":                   orgTypeResidential,
+	"college":                  orgTypeEducation,
+	"school":                   orgTypeEducation,
+	"library":                  orgTypeEducation,
+	"business":                 orgTypeBusiness,
+	"cafe":                     orgTypeBusiness,
+	"government":               orgTypeBusiness,
+	"military":                 orgTypeBusiness,
+	"router":                   orgTypeBusiness,
+	"traveler":                 orgTypeBusiness,
+}
+
+// orgKeywords classifies an AS organization name when no better trait is available
+var orgKeywords = []struct {
+	keyword string
+	orgType string
+}{
+	{"university", orgTypeEducation},
+	{"college", orgTypeEducation},
+	{"school", orgTypeEducation},
+	{"hosting", orgTypeHosting},
+	{"cloud", orgTypeHosting},
+	{"data center", orgTypeHosting},
+	{"datacenter", orgTypeHosting},
+	{"server", orgTypeHosting},
+	{"mobile", orgTypeMobile},
+	{"wireless", orgTypeMobile},
+	{"cellular", orgTypeMobile},
+}
+
+// classifyOrg returns the organization type from the most specific data available.
+// The Enterprise user type is preferred, then the Anonymous IP hosting flag, then keywords in the AS organization.
+func classifyOrg(userType string, isHostingProvider bool, asnOrg string) string {
+	if orgType, ok := userTypeOrgTypes[userType]; ok {
+		return orgType
+	}
+	if isHostingProvider {
+		return orgTypeHosting
+	}
+
+	asnOrg = strings.ToLower(asnOrg)
+	for _, k := range orgKeywords {
+		if strings.Contains(asnOrg, k.keyword) {
+			return k.orgType
+		}
+	}
+
+	return ""
+}
+
+// setOrgType sets the organization type of the network, if it can be classified
+func (m *Handler) setOrgType(repl placeholderSetter, traits networkTraits) {
+	if orgType := classifyOrg(traits.userType, traits.hosting, traits.asnOrg); orgType != "" {
+		repl.Set("geoip2.org_type", orgType)
+	}
+}
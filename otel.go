@@ -0,0 +1,53 @@
+package geoip2
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanAttributes maps the OpenTelemetry semantic convention geo attributes to the placeholders they are taken from
+var spanAttributes = []struct {
+	attribute   string
+	placeholder string
+}{
+	{"geo.continent.code", "geoip2.continent_code"},
+	{"geo.country.iso_code", "geoip2.country_code"},
+	{"geo.locality.name", "geoip2.city_name"},
+	{"geo.postal_code", "geoip2.postal_code"},
+	{"geo.location.lat", "geoip2.location_latitude"},
+	{"geo.location.lon", "geoip2.location_longitude"},
+}
+
+// setSpanAttributes adds the resolved location to the current span of r, if one is recording
+func (m *Handler) setSpanAttributes(r *http.Request, repl *caddy.Replacer) {
+	var span = trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+
+	var attrs = make([]attribute.KeyValue, 0, len(spanAttributes))
+	for _, a := range spanAttributes {
+		v, ok := repl.Get(a.placeholder)
+		if !ok {
+			continue
+		}
+
+		switch v := v.(type) {
+		case string:
+			if v != "" && v != m.UnknownValue {
+				attrs = append(attrs, attribute.String(a.attribute, v))
+			}
+		case float64:
+			attrs = append(attrs, attribute.Float64(a.attribute, v))
+		case *float64:
+			if v != nil {
+				attrs = append(attrs, attribute.Float64(a.attribute, *v))
+			}
+		}
+	}
+
+	span.SetAttributes(attrs...)
+}
@@ -0,0 +1,90 @@
+package geoip2
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// progressInterval is how often the progress of a download is logged
+const progressInterval = 5 * time.Second
+
+// progressTransport logs the progress of database downloads made through it
+type progressTransport struct {
+	base http.RoundTripper
+	log  *zap.Logger
+}
+
+// withProgress returns a copy of client that logs the progress of downloads
+func withProgress(client *http.Client, log *zap.Logger) *http.Client {
+	var base = client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	var c = *client
+	c.Transport = progressTransport{base: base, log: log}
+	return &c
+}
+
+func (t progressTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	resp.Body = &progressReader{
+		ReadCloser: resp.Body,
+		log:        t.log,
+		total:      resp.ContentLength,
+		start:      time.Now(),
+		logged:     time.Now(),
+	}
+	return resp, nil
+}
+
+// progressReader counts the bytes read from a download, logging the progress every progressInterval
+type progressReader struct {
+	io.ReadCloser
+	log *zap.Logger
+
+	// The size of the download, or -1 if unknown
+	total  int64
+	read   int64
+	start  time.Time
+	logged time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.read += int64(n)
+
+	if now := time.Now(); now.Sub(p.logged) >= progressInterval {
+		p.logged = now
+		p.logProgress(now)
+	}
+
+	return n, err
+}
+
+func (p *progressReader) logProgress(now time.Time) {
+	var fields = []zap.Field{zap.Int64("bytes", p.read)}
+
+	if p.total > 0 {
+		var (
+			elapsed = now.Sub(p.start)
+			percent = float64(p.read) / float64(p.total) * 100
+		)
+		fields = append(fields, zap.Int64("total_bytes", p.total), zap.Float64("percent", math.Round(percent*10)/10))
+
+		if p.read > 0 {
+			var remaining = time.Duration(float64(elapsed) * float64(p.total-p.read) / float64(p.read))
+			fields = append(fields, zap.Duration("eta", remaining.Round(time.Second)))
+		}
+	}
+
+	p.log.Info("downloading database", fields...)
+}
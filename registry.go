@@ -0,0 +1,100 @@
+package geoip2
+
+import "sort"
+
+// asnBlock is a block of AS numbers allocated by IANA to a regional internet registry
+type asnBlock struct {
+	first, last uint
+	registry    string
+}
+
+// asnBlocks are the AS number blocks allocated to each registry, sorted by number.
+// Numbers transferred between registries after allocation are reported as the registry they were allocated to.
+var asnBlocks = []asnBlock{
+	{1, 1876, "arin"},
+	{1877, 1901, "ripe"},
+	{1902, 2042, "arin"},
+	{2043, 2043, "ripe"},
+	{2044, 2046, "arin"},
+	{2047, 2047, "ripe"},
+	{2048, 2106, "arin"},
+	{2107, 2136, "ripe"},
+	{2137, 2584, "arin"},
+	{2585, 2614, "ripe"},
+	{2615, 2772, "arin"},
+	{2773, 2822, "ripe"},
+	{2823, 2829, "arin"},
+	{2830, 2879, "ripe"},
+	{2880, 3153, "arin"},
+	{3154, 3353, "ripe"},
+	{3354, 4607, "arin"},
+	{4608, 4865, "apnic"},
+	{4866, 5376, "arin"},
+	{5377, 5631, "ripe"},
+	{5632, 6655, "arin"},
+	{6656, 6911, "ripe"},
+	{6912, 7466, "arin"},
+	{7467, 7722, "apnic"},
+	{7723, 8191, "arin"},
+	{8192, 9215, "ripe"},
+	{9216, 10239, "apnic"},
+	{10240, 12287, "arin"},
+	{12288, 13311, "ripe"},
+	{13312, 15359, "arin"},
+	{15360, 16383, "ripe"},
+	{16384, 17407, "arin"},
+	{17408, 18431, "apnic"},
+	{18432, 20479, "arin"},
+	{20480, 21503, "ripe"},
+	{21504, 23551, "arin"},
+	{23552, 24575, "apnic"},
+	{24576, 25599, "ripe"},
+	{25600, 27647, "arin"},
+	{27648, 28671, "lacnic"},
+	{28672, 29695, "ripe"},
+	{29696, 30719, "arin"},
+	{30720, 31743, "ripe"},
+	{31744, 33791, "arin"},
+	{33792, 35839, "ripe"},
+	{35840, 36863, "arin"},
+	{36864, 37887, "afrinic"},
+	{37888, 38911, "apnic"},
+	{38912, 39935, "ripe"},
+	{39936, 40959, "arin"},
+	{40960, 45055, "ripe"},
+	{45056, 46079, "apnic"},
+	{46080, 47103, "arin"},
+	{47104, 52223, "ripe"},
+	{52224, 53247, "lacnic"},
+	{53248, 55295, "arin"},
+	{55296, 56319, "apnic"},
+	{56320, 58367, "ripe"},
+	{58368, 59391, "apnic"},
+	{59392, 61439, "ripe"},
+	{61440, 61951, "lacnic"},
+	{61952, 62463, "ripe"},
+	{62464, 63487, "arin"},
+	{63488, 63999, "apnic"},
+	{64000, 64098, "arin"},
+	{64099, 64197, "apnic"},
+	{64198, 64296, "ripe"},
+	{64297, 64395, "arin"},
+	// 32-bit AS numbers are allocated in blocks of 65536, written as 2.0 to 2.65535 in asdot notation
+	{2 << 16, 3<<16 - 1, "apnic"},
+	{3 << 16, 4<<16 - 1, "ripe"},
+	{4 << 16, 5<<16 - 1, "lacnic"},
+	{5 << 16, 6<<16 - 1, "afrinic"},
+	{6 << 16, 7<<16 - 1, "arin"},
+}
+
+// asnRegistry returns the regional internet registry the AS number was allocated to, if any
+func asnRegistry(asn uint) (string, bool) {
+	i := sort.Search(len(asnBlocks), func(i int) bool {
+		return asnBlocks[i].last >= asn
+	})
+	if i == len(asnBlocks) || asn < asnBlocks[i].first {
+		return "", false
+	}
+
+	return asnBlocks[i].registry, true
+}
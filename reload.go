@@ -0,0 +1,81 @@
+package geoip2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// runningDatabases records the database files used by the most recently started app,
+// so that an app replaced by a reload can remove the files it downloaded that the new config no longer uses.
+var runningDatabases = struct {
+	mx    sync.Mutex
+	paths map[string]bool
+}{}
+
+// useDatabases records the files of databases as the ones used by the running config
+func useDatabases(databases []*Database) {
+	runningDatabases.mx.Lock()
+	defer runningDatabases.mx.Unlock()
+
+	runningDatabases.paths = make(map[string]bool, len(databases))
+	for _, db := range databases {
+		runningDatabases.paths[filepath.Clean(db.filePath)] = true
+	}
+}
+
+// removeUnusedDatabases removes the files of databases that were downloaded by Caddy
+// but are not used by the running config, such as editions removed from edition_id.
+// Files managed outside Caddy, like database_files and pinned editions, are never removed.
+func removeUnusedDatabases(log *zap.Logger, databases []*Database) {
+	runningDatabases.mx.Lock()
+	defer runningDatabases.mx.Unlock()
+
+	for _, db := range databases {
+		var filePath = filepath.Clean(db.filePath)
+		if db.updater == nil || runningDatabases.paths[filePath] {
+			continue
+		}
+
+		log.Info("removing database of edition no longer configured", zap.String("edition", db.Edition()), zap.String("path", filePath))
+
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Warn("failed to remove database", zap.String("edition", db.Edition()), zap.Error(err))
+		}
+		_ = os.Remove(filePath + ".lock")
+		pruneVersions(filePath, 0)
+	}
+}
+
+// databasePool holds the open databases keyed by the app config they were opened with.
+// When a reload only changes other parts of the Caddy config, the new app reuses the databases of the old one,
+// along with their automatic updates, instead of opening them again.
+var databasePool = caddy.NewUsagePool()
+
+// databaseSet is the databases opened for an app config
+type databaseSet []*Database
+
+func (s databaseSet) Destruct() error {
+	for _, db := range s {
+		_ = db.Close()
+	}
+
+	return nil
+}
+
+// poolKey identifies the databases opened for the app config g
+func poolKey(g *GeoIp2) (string, error) {
+	b, err := json.Marshal(g)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,75 @@
+package geoip2
+
+import (
+	"net/netip"
+	"time"
+)
+
+// recordedPlaceholder is a single placeholder set by a lookup
+type recordedPlaceholder struct {
+	key   string
+	value any
+}
+
+// placeholderRecorder records the placeholders set through it so that they can be replayed for the next request
+type placeholderRecorder struct {
+	repl   placeholderSetter
+	values []recordedPlaceholder
+}
+
+func (p *placeholderRecorder) Set(variable string, value any) {
+	p.values = append(p.values, recordedPlaceholder{key: variable, value: value})
+	p.repl.Set(variable, value)
+}
+
+// reuseCacheSize is the number of clients whose last lookup is remembered for reuse_window
+const reuseCacheSize = 1024
+
+// reusedLookup is the result of a lookup, remembered so that bursts of requests from the same IP,
+// like those multiplexed over one HTTP/2 connection, do not repeat it
+type reusedLookup struct {
+	expires time.Time
+	values  []recordedPlaceholder
+	served  []*Database
+}
+
+// replay sets the placeholders of the last lookup of ip if it has not expired
+func (m *Handler) replay(ip netip.Addr, repl placeholderSetter) ([]*Database, bool) {
+	l, ok := m.reused.get(ip)
+	if !ok || time.Now().After(l.expires) {
+		return nil, false
+	}
+
+	for _, v := range l.values {
+		repl.Set(v.key, v.value)
+	}
+
+	return l.served, true
+}
+
+// lookupReusing performs the database lookups for ip, reusing the last result for the same IP within reuse_window.
+// It reports whether the last result was reused.
+func (m *Handler) lookupReusing(ip netip.Addr, repl placeholderSetter) ([]*Database, bool) {
+	if m.ReuseWindow <= 0 {
+		served, traits := m.lookup(ip, repl, m.databases)
+		m.setOrgType(repl, traits)
+		m.setCDNEdge(repl, traits)
+		return served, false
+	}
+
+	if served, ok := m.replay(ip, repl); ok {
+		return served, true
+	}
+
+	var rec = &placeholderRecorder{repl: repl}
+	served, traits := m.lookup(ip, rec, m.databases)
+	m.setOrgType(rec, traits)
+	m.setCDNEdge(rec, traits)
+
+	m.reused.put(ip, &reusedLookup{
+		expires: time.Now().Add(time.Duration(m.ReuseWindow)),
+		values:  rec.values,
+		served:  served,
+	})
+	return served, false
+}
@@ -0,0 +1,72 @@
+package geoip2
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestLookupReusing(t *testing.T) {
+	var (
+		db = openDatabase(t, "GeoLite2-City", cityDatabase(t), OpenOptions{})
+		m  = &Handler{
+			state:       &GeoIp2{Locale: "en"},
+			databases:   []*Database{db},
+			ReuseWindow: caddy.Duration(time.Minute),
+			reused:      newLRUCache[netip.Addr, *reusedLookup](reuseCacheSize),
+		}
+		london = netip.MustParseAddr("81.2.69.1")
+		berlin = netip.MustParseAddr("5.6.7.8")
+	)
+
+	for _, c := range []struct {
+		ip      netip.Addr
+		reused  bool
+		country string
+	}{
+		{london, false, "GB"},
+		{berlin, false, "DE"},
+		// Lookups are reused for each client, not only the last one
+		{london, true, "GB"},
+		{berlin, true, "DE"},
+	} {
+		var repl = caddy.NewReplacer()
+		_, reused := m.lookupReusing(c.ip, repl)
+		if reused != c.reused {
+			t.Errorf("%s: reused = %v, want %v", c.ip, reused, c.reused)
+		}
+		if country, _ := repl.GetString("geoip2.country_code"); country != c.country {
+			t.Errorf("%s: country_code = %q, want %q", c.ip, country, c.country)
+		}
+	}
+}
+
+func BenchmarkLookupReusing(b *testing.B) {
+	var (
+		db = openDatabase(b, "GeoLite2-City", cityDatabase(b), OpenOptions{})
+		m  = &Handler{
+			state:       &GeoIp2{Locale: "en"},
+			databases:   []*Database{db},
+			ReuseWindow: caddy.Duration(time.Minute),
+			reused:      newLRUCache[netip.Addr, *reusedLookup](reuseCacheSize),
+		}
+	)
+
+	// Requests from a few hundred clients are interleaved, as they would be on a busy server
+	var ips []netip.Addr
+	for i := range 256 {
+		ips = append(ips, netip.MustParseAddr(fmt.Sprintf("81.2.69.%d", i)))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			m.lookupReusing(ips[i%len(ips)], caddy.NewReplacer())
+			i++
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package geoip2
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// SessionConfig configures tracking the country of each session,
+// to detect sessions whose client IP moved to another country.
+type SessionConfig struct {
+	// The cookie holding the session token
+	Cookie string `json:"cookie,omitempty"`
+	// The request header holding the session token, used when cookie is not set
+	Header string `json:"header,omitempty"`
+	// How long in seconds the country of a session is remembered after it was last seen. Defaults to 86400
+	TTL int `json:"ttl,omitempty"`
+	// The maximum number of sessions remembered. Defaults to 100000
+	Size int `json:"size,omitempty"`
+}
+
+func (c *SessionConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var value string
+		key := d.Val()
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		switch key {
+		case "cookie":
+			c.Cookie = value
+			break
+		case "header":
+			c.Header = value
+			break
+		case "ttl":
+			TTL, err := strconv.Atoi(value)
+			if err == nil {
+				c.TTL = TTL
+			}
+			break
+		case "size":
+			Size, err := strconv.Atoi(value)
+			if err == nil {
+				c.Size = Size
+			}
+			break
+		default:
+			return d.Errf("unknown session_tracking option %q", key)
+		}
+	}
+
+	return nil
+}
+
+type sessionEntry struct {
+	country string
+	expires time.Time
+}
+
+// sessionKey is a fixed size key for a session token, so that long tokens sent by clients do not grow the store
+type sessionKey [16]byte
+
+func newSessionKey(token string) sessionKey {
+	var sum = sha256.Sum256([]byte(token))
+	return sessionKey(sum[:16])
+}
+
+// sessionStore remembers the last seen country of each session for a limited time
+type sessionStore struct {
+	cookie string
+	header string
+	ttl    time.Duration
+
+	// The least recently seen sessions are evicted once the store is full
+	sessions *lruCache[sessionKey, sessionEntry]
+}
+
+func newSessionStore(config *SessionConfig) *sessionStore {
+	var (
+		s = &sessionStore{
+			cookie: config.Cookie,
+			header: config.Header,
+			ttl:    24 * time.Hour,
+		}
+		size = 100000
+	)
+
+	if config.TTL > 0 {
+		s.ttl = time.Second * time.Duration(config.TTL)
+	}
+	if config.Size > 0 {
+		size = config.Size
+	}
+	s.sessions = newLRUCache[sessionKey, sessionEntry](size)
+
+	return s
+}
+
+// token returns the session token of r, if any
+func (s *sessionStore) token(r *http.Request) string {
+	if s.cookie != "" {
+		if c, err := r.Cookie(s.cookie); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+
+	return r.Header.Get(s.header)
+}
+
+// seen records country as the last seen country of the session token,
+// returning the country it was last seen in and whether the session was known
+func (s *sessionStore) seen(token, country string) (string, bool) {
+	var (
+		key = newSessionKey(token)
+		now = time.Now()
+	)
+
+	last, ok := s.sessions.get(key)
+	if ok && now.After(last.expires) {
+		ok = false
+	}
+
+	s.sessions.put(key, sessionEntry{country: country, expires: now.Add(s.ttl)})
+
+	return last.country, ok
+}
+
+// countryChanged sets whether the country of the session of r differs from the one it was last seen in
+func (m *Handler) countryChanged(r *http.Request, repl placeholderSetter, country string) {
+	var token = m.sessions.token(r)
+	if token == "" || country == "" {
+		return
+	}
+
+	if last, ok := m.sessions.seen(token, country); ok {
+		repl.Set("geoip2.country_changed", last != country)
+	}
+}
@@ -0,0 +1,46 @@
+package geoip2
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionStore(t *testing.T) {
+	var s = newSessionStore(&SessionConfig{Cookie: "session", Size: 2})
+
+	if _, ok := s.seen("a", "GB"); ok {
+		t.Error("new session a is known")
+	}
+	if last, ok := s.seen("a", "DE"); !ok || last != "GB" {
+		t.Errorf("seen(a) = %q, %v, want GB, true", last, ok)
+	}
+	if last, ok := s.seen("a", "DE"); !ok || last != "DE" {
+		t.Errorf("seen(a) = %q, %v, want DE, true", last, ok)
+	}
+
+	// The least recently seen session is evicted once the store is full
+	s.seen("b", "FR")
+	s.seen("a", "DE")
+	s.seen("c", "NL")
+	if _, ok := s.seen("b", "FR"); ok {
+		t.Error("least recently seen session b was not evicted")
+	}
+
+	// Long tokens are stored by a fixed size key
+	var long = strings.Repeat("x", 1<<16)
+	s.seen(long, "GB")
+	if last, ok := s.seen(long, "GB"); !ok || last != "GB" {
+		t.Errorf("seen(long) = %q, %v, want GB, true", last, ok)
+	}
+	if _, ok := s.seen(long+"y", "GB"); ok {
+		t.Error("a different long token is known")
+	}
+
+	// Expired sessions are no longer known
+	s.ttl = -time.Second
+	s.seen("d", "GB")
+	if _, ok := s.seen("d", "GB"); ok {
+		t.Error("expired session d is known")
+	}
+}
@@ -0,0 +1,97 @@
+package geoip2
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// lookupEvent describes a single lookup performed by the handler
+type lookupEvent struct {
+	IP       string   `json:"ip"`
+	Country  string   `json:"country,omitempty"`
+	City     string   `json:"city,omitempty"`
+	ASN      string   `json:"asn,omitempty"`
+	Editions []string `json:"editions,omitempty"`
+}
+
+func newLookupEvent(ip netip.Addr, repl *caddy.Replacer, served []*Database) lookupEvent {
+	var ev = lookupEvent{IP: ip.String()}
+	ev.Country, _ = repl.GetString("geoip2.country_code")
+	ev.City, _ = repl.GetString("geoip2.city_name")
+	ev.ASN, _ = repl.GetString("geoip2.asn_system_number")
+
+	for _, db := range served {
+		if db != nil && !slices.Contains(ev.Editions, db.Edition()) {
+			ev.Editions = append(ev.Editions, db.Edition())
+		}
+	}
+
+	return ev
+}
+
+// tailSubscriber receives a sample of lookup events
+type tailSubscriber struct {
+	sampleRate float64
+	events     chan lookupEvent
+}
+
+// tailHub fans out lookup events to subscribers of the admin lookup stream
+type tailHub struct {
+	mx          sync.RWMutex
+	subscribers map[*tailSubscriber]struct{}
+	count       atomic.Int32
+}
+
+var lookupTail = &tailHub{
+	subscribers: make(map[*tailSubscriber]struct{}),
+}
+
+// active reports whether there are any subscribers, so that callers can skip building events entirely
+func (h *tailHub) active() bool {
+	return h.count.Load() > 0
+}
+
+func (h *tailHub) subscribe(sampleRate float64) *tailSubscriber {
+	var sub = &tailSubscriber{
+		sampleRate: sampleRate,
+		events:     make(chan lookupEvent, 64),
+	}
+
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	h.subscribers[sub] = struct{}{}
+	h.count.Add(1)
+
+	return sub
+}
+
+func (h *tailHub) unsubscribe(sub *tailSubscriber) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	delete(h.subscribers, sub)
+	h.count.Add(-1)
+}
+
+func (h *tailHub) publish(ev lookupEvent) {
+	h.mx.RLock()
+	defer h.mx.RUnlock()
+
+	for sub := range h.subscribers {
+		if sub.sampleRate < 1 && rand.Float64() >= sub.sampleRate {
+			continue
+		}
+
+		// Never block the request path on a slow subscriber
+		select {
+		case sub.events <- ev:
+		default:
+		}
+	}
+}
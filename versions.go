@@ -0,0 +1,121 @@
+package geoip2
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// versionPrefix returns the path of the versions of the database at filePath, without the content hash and extension
+func versionPrefix(filePath string) (string, string) {
+	var ext = filepath.Ext(filePath)
+	return strings.TrimSuffix(filePath, ext) + "-", ext
+}
+
+// isVersion reports whether name is a version of the database at filePath, named by a 16 character content hash
+func isVersion(filePath, name string) bool {
+	prefix, ext := versionPrefix(filePath)
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+		return false
+	}
+
+	var sum = strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+	_, err := hex.DecodeString(sum)
+	return len(sum) == 16 && err == nil
+}
+
+// fileHash returns the start of the hex encoded SHA-256 of the file at path
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var h = sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// keepVersion moves a database written to filePath to a file named by its content hash
+// and atomically replaces filePath with a symlink to it, then removes all but the newest keep versions.
+// Previous versions stay on disk so that a bad update can be rolled back by pointing the symlink at one of them.
+func keepVersion(filePath string, keep int) error {
+	fi, err := os.Lstat(filePath)
+	if err != nil {
+		return err
+	}
+
+	// The database is already versioned
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+
+	sum, err := fileHash(filePath)
+	if err != nil {
+		return err
+	}
+
+	prefix, ext := versionPrefix(filePath)
+	var target = prefix + sum + ext
+	if err := os.Link(filePath, target); err != nil && !os.IsExist(err) {
+		return err
+	}
+	// The version is dated by when it was downloaded, which orders versions for retention
+	_ = os.Chtimes(target, time.Now(), time.Now())
+
+	var link = filePath + ".symlink"
+	_ = os.Remove(link)
+	if err := os.Symlink(filepath.Base(target), link); err != nil {
+		return err
+	}
+	if err := os.Rename(link, filePath); err != nil {
+		_ = os.Remove(link)
+		return err
+	}
+
+	pruneVersions(filePath, keep)
+	return nil
+}
+
+// pruneVersions removes all but the newest keep versions of the database at filePath.
+// The version filePath points to is always kept.
+func pruneVersions(filePath string, keep int) {
+	prefix, ext := versionPrefix(filePath)
+	matches, _ := filepath.Glob(prefix + "*" + ext)
+
+	type version struct {
+		path    string
+		modTime time.Time
+	}
+
+	var versions []version
+	for _, match := range matches {
+		if !isVersion(filePath, match) {
+			continue
+		}
+		if fi, err := os.Stat(match); err == nil {
+			versions = append(versions, version{path: match, modTime: fi.ModTime()})
+		}
+	}
+
+	slices.SortFunc(versions, func(a, b version) int {
+		return b.modTime.Compare(a.modTime)
+	})
+
+	current, _ := os.Readlink(filePath)
+	for i, v := range versions {
+		if i < keep || filepath.Base(v.path) == current {
+			continue
+		}
+		_ = os.Remove(v.path)
+	}
+}
@@ -0,0 +1,210 @@
+package geoip2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/oschwald/geoip2-golang/v2"
+	"golang.org/x/time/rate"
+)
+
+var errRateLimited = errors.New("web service rate limit exceeded")
+
+// WebServiceConfig configures the MaxMind GeoIP2 web service used when a local lookup misses.
+// Requests are authenticated with the account_id and license_key of the geoip2 app.
+type WebServiceConfig struct {
+	// The web service endpoint the IP address is appended to. Defaults to https://geoip.maxmind.com/geoip/v2.1/city
+	Endpoint string `json:"endpoint,omitempty"`
+	// The timeout in seconds for each request. Defaults to 2
+	Timeout int `json:"timeout,omitempty"`
+	// How long in seconds to cache responses, including IPs the web service has no data for or reports as reserved. Defaults to 86400
+	CacheTTL int `json:"cache_ttl,omitempty"`
+	// The maximum number of cached responses. Defaults to 10000
+	CacheSize int `json:"cache_size,omitempty"`
+	// The maximum number of requests per second to the web service. Defaults to 1
+	RateLimit float64 `json:"rate_limit,omitempty"`
+}
+
+func (c *WebServiceConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var value string
+		key := d.Val()
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		switch key {
+		case "endpoint":
+			c.Endpoint = value
+			break
+		case "timeout":
+			Timeout, err := strconv.Atoi(value)
+			if err == nil {
+				c.Timeout = Timeout
+			}
+			break
+		case "cache_ttl":
+			CacheTTL, err := strconv.Atoi(value)
+			if err == nil {
+				c.CacheTTL = CacheTTL
+			}
+			break
+		case "cache_size":
+			CacheSize, err := strconv.Atoi(value)
+			if err == nil {
+				c.CacheSize = CacheSize
+			}
+			break
+		case "rate_limit":
+			RateLimit, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				c.RateLimit = RateLimit
+			}
+			break
+		default:
+			return d.Errf("unknown web_service_fallback option %q", key)
+		}
+	}
+
+	return nil
+}
+
+type webServiceEntry struct {
+	rec     *geoip2.City
+	expires time.Time
+}
+
+// webService is a rate limited and cached client for the MaxMind GeoIP2 web service.
+// It is owned by the app so that every handler shares one cache and rate limit.
+type webService struct {
+	endpoint   string
+	accountID  string
+	licenseKey string
+
+	client  *http.Client
+	limiter *rate.Limiter
+	ttl     time.Duration
+	cache   *lruCache[netip.Addr, webServiceEntry]
+}
+
+func newWebService(config *WebServiceConfig, accountID, licenseKey string) *webService {
+	var (
+		ws = &webService{
+			endpoint:   config.Endpoint,
+			accountID:  accountID,
+			licenseKey: licenseKey,
+			client:     &http.Client{Timeout: 2 * time.Second},
+			limiter:    rate.NewLimiter(1, 1),
+			ttl:        24 * time.Hour,
+		}
+		size = 10000
+	)
+
+	if ws.endpoint == "" {
+		ws.endpoint = "https://geoip.maxmind.com/geoip/v2.1/city"
+	}
+	if config.Timeout > 0 {
+		ws.client.Timeout = time.Second * time.Duration(config.Timeout)
+	}
+	if config.RateLimit > 0 {
+		ws.limiter = rate.NewLimiter(rate.Limit(config.RateLimit), 1)
+	}
+	if config.CacheTTL > 0 {
+		ws.ttl = time.Second * time.Duration(config.CacheTTL)
+	}
+	if config.CacheSize > 0 {
+		size = config.CacheSize
+	}
+	ws.cache = newLRUCache[netip.Addr, webServiceEntry](size)
+
+	return ws
+}
+
+func (ws *webService) cached(ip netip.Addr) (webServiceEntry, bool) {
+	entry, ok := ws.cache.get(ip)
+	if ok && time.Now().After(entry.expires) {
+		return entry, false
+	}
+
+	return entry, ok
+}
+
+func (ws *webService) store(ip netip.Addr, rec *geoip2.City) {
+	ws.cache.put(ip, webServiceEntry{rec: rec, expires: time.Now().Add(ws.ttl)})
+}
+
+// webServiceError is the body of an error response of the web service
+type webServiceError struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// noDataCodes are the error codes for IP addresses the web service will never have data for
+var noDataCodes = []string{"IP_ADDRESS_INVALID", "IP_ADDRESS_NOT_FOUND", "IP_ADDRESS_RESERVED"}
+
+// City looks up ip using the web service.
+// A nil record without an error means the web service has no data for ip.
+func (ws *webService) City(ctx context.Context, ip netip.Addr) (*geoip2.City, error) {
+	// Private and reserved addresses are answered with an error, which would only use up the rate limit and queries
+	if !isGlobalIP(ip) {
+		return nil, nil
+	}
+	if entry, ok := ws.cached(ip); ok {
+		return entry.rec, nil
+	}
+
+	if !ws.limiter.Allow() {
+		return nil, errRateLimited
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ws.endpoint+"/"+ip.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(ws.accountID, ws.licenseKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// The IP address is not in the database, don't ask again
+		ws.store(ip, nil)
+		return nil, nil
+	default:
+		var body webServiceError
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+
+		// The IP address is reserved or invalid, don't ask again
+		if resp.StatusCode == http.StatusBadRequest && slices.Contains(noDataCodes, body.Code) {
+			ws.store(ip, nil)
+			return nil, nil
+		}
+		if body.Code != "" {
+			return nil, fmt.Errorf("web service returned %s: %s: %s", resp.Status, body.Code, body.Error)
+		}
+		return nil, fmt.Errorf("web service returned %s", resp.Status)
+	}
+
+	var rec geoip2.City
+	err = json.NewDecoder(resp.Body).Decode(&rec)
+	if err != nil {
+		return nil, fmt.Errorf("decoding web service response: %w", err)
+	}
+
+	ws.store(ip, &rec)
+
+	return &rec, nil
+}
@@ -0,0 +1,99 @@
+package geoip2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestWebService(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		switch ip := strings.TrimPrefix(r.URL.Path, "/"); ip {
+		case "81.2.69.1":
+			_, _ = w.Write([]byte(`{"country":{"iso_code":"GB"}}`))
+		case "5.6.7.8":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"code":"IP_ADDRESS_NOT_FOUND","error":"not found"}`))
+		case "2.2.2.2":
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"code":"IP_ADDRESS_RESERVED","error":"reserved"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"code":"AUTHORIZATION_INVALID","error":"invalid license key"}`))
+		}
+	}))
+	defer srv.Close()
+
+	var ws = newWebService(&WebServiceConfig{Endpoint: srv.URL}, "1", "test")
+	ws.limiter = rate.NewLimiter(rate.Inf, 1)
+
+	for _, c := range []struct {
+		name     string
+		ip       string
+		country  string
+		err      bool
+		requests int32
+	}{
+		{"found", "81.2.69.1", "GB", false, 1},
+		{"found cached", "81.2.69.1", "GB", false, 0},
+		{"not found", "5.6.7.8", "", false, 1},
+		{"not found cached", "5.6.7.8", "", false, 0},
+		// Addresses the web service reports as reserved are cached as having no data
+		{"reserved", "2.2.2.2", "", false, 1},
+		{"reserved cached", "2.2.2.2", "", false, 0},
+		// Other errors are not cached
+		{"error", "8.8.8.8", "", true, 1},
+		{"error again", "8.8.8.8", "", true, 1},
+		// Private and reserved addresses are never queried
+		{"private", "10.0.0.1", "", false, 0},
+		{"loopback", "::1", "", false, 0},
+		{"documentation", "198.51.100.17", "", false, 0},
+		{"carrier-grade NAT", "100.64.0.1", "", false, 0},
+		{"IPv4-mapped private", "::ffff:192.168.0.1", "", false, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var before = requests.Load()
+			rec, err := ws.City(context.Background(), netip.MustParseAddr(c.ip))
+			if (err != nil) != c.err {
+				t.Errorf("error = %v, want error %v", err, c.err)
+			}
+
+			var country string
+			if rec != nil {
+				country = rec.Country.ISOCode
+			}
+			if country != c.country {
+				t.Errorf("country = %q, want %q", country, c.country)
+			}
+			if n := requests.Load() - before; n != c.requests {
+				t.Errorf("made %d requests, want %d", n, c.requests)
+			}
+		})
+	}
+}
+
+func TestWebServiceCacheSize(t *testing.T) {
+	var ws = newWebService(&WebServiceConfig{CacheSize: 2}, "1", "test")
+	for _, ip := range []string{"81.2.69.1", "81.2.69.2", "81.2.69.3"} {
+		ws.store(netip.MustParseAddr(ip), nil)
+	}
+
+	// The least recently stored response is evicted
+	if _, ok := ws.cached(netip.MustParseAddr("81.2.69.1")); ok {
+		t.Error("81.2.69.1 was not evicted")
+	}
+	for _, ip := range []string{"81.2.69.2", "81.2.69.3"} {
+		if _, ok := ws.cached(netip.MustParseAddr(ip)); !ok {
+			t.Errorf("%s is not cached", ip)
+		}
+	}
+}